@@ -0,0 +1,162 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Clock is the source of time used to wait between requests. It can be
+// replaced on tests to avoid real waits.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is a Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RetryPolicy decides how long to wait before the next request
+type RetryPolicy interface {
+	Next() time.Duration // Delay before the next attempt
+	Reset()              // Start again from the first delay
+}
+
+// Backoff is a RetryPolicy that grows the delay exponentially on every
+// attempt until it reaches a maximum. A random jitter is applied to the delay
+// so many sensors restarted at the same time don't poll in lockstep.
+type Backoff struct {
+	attempt int
+
+	config BackoffConfig
+}
+
+// NewBackoff creates a new exponential backoff policy. It returns nil if the
+// configuration is not valid.
+func NewBackoff(config BackoffConfig) *Backoff {
+	b := &Backoff{
+		config: config,
+	}
+
+	if b.config.Initial <= 0 || b.config.Max < b.config.Initial {
+		return nil
+	}
+	if b.config.Multiplier < 1 {
+		return nil
+	}
+	if b.config.Jitter < 0 || b.config.Jitter > 1 {
+		return nil
+	}
+	if b.config.Rand == nil {
+		b.config.Rand = rand.Float64
+	}
+
+	return b
+}
+
+// Next returns the delay for the current attempt and moves to the next one
+func (b *Backoff) Next() time.Duration {
+	delay := float64(b.config.Initial) * math.Pow(b.config.Multiplier, float64(b.attempt))
+	if delay < float64(b.config.Max) {
+		b.attempt++
+	} else {
+		delay = float64(b.config.Max)
+	}
+
+	return jitter(time.Duration(delay), b.config.Jitter, b.config.Max, b.config.Rand)
+}
+
+// Reset starts again from the initial delay
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// ClaimSchedule is a RetryPolicy for the claim wait. The sensor is usually
+// claimed shortly after being installed, so it polls often during a first
+// window and then falls back to a slow interval.
+type ClaimSchedule struct {
+	start time.Time
+
+	config ClaimScheduleConfig
+}
+
+// NewClaimSchedule creates a new fast-then-slow schedule. It returns nil if
+// the configuration is not valid.
+func NewClaimSchedule(config ClaimScheduleConfig) *ClaimSchedule {
+	s := &ClaimSchedule{
+		config: config,
+	}
+
+	if s.config.Fast <= 0 || s.config.Slow < s.config.Fast || s.config.FastFor < 0 {
+		return nil
+	}
+	if s.config.Jitter < 0 || s.config.Jitter > 1 {
+		return nil
+	}
+	if s.config.Clock == nil {
+		s.config.Clock = realClock{}
+	}
+	if s.config.Rand == nil {
+		s.config.Rand = rand.Float64
+	}
+
+	return s
+}
+
+// Next returns the fast interval while the fast window is open and the slow
+// one after it. The window starts on the first call.
+func (s *ClaimSchedule) Next() time.Duration {
+	now := s.config.Clock.Now()
+	if s.start.IsZero() {
+		s.start = now
+	}
+
+	delay := s.config.Slow
+	if now.Sub(s.start) < s.config.FastFor {
+		delay = s.config.Fast
+	}
+
+	return jitter(delay, s.config.Jitter, s.config.Slow, s.config.Rand)
+}
+
+// Reset opens the fast window again
+func (s *ClaimSchedule) Reset() {
+	s.start = time.Time{}
+}
+
+// jitter randomizes delay up to the given fraction in both directions without
+// exceeding max
+func jitter(delay time.Duration, fraction float64, max time.Duration, random func() float64) time.Duration {
+	if fraction == 0 {
+		return delay
+	}
+
+	delay = time.Duration(float64(delay) * (1 + fraction*(2*random()-1)))
+	if delay > max {
+		delay = max
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	return delay
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a Clock that only moves when someone waits on it
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// Random source that always returns the same value
+func fixedRand(v float64) func() float64 {
+	return func() float64 { return v }
+}
+
+// Test invalid backoff configurations
+func Test_NewBackoff_Invalid(t *testing.T) {
+	assert.Nil(t, NewBackoff(BackoffConfig{}), "Backoff should be nil")
+	assert.Nil(t, NewBackoff(BackoffConfig{
+		Initial: 10 * time.Second, Max: time.Second, Multiplier: 2,
+	}), "Backoff should be nil")
+	assert.Nil(t, NewBackoff(BackoffConfig{
+		Initial: time.Second, Max: 10 * time.Second, Multiplier: 0.5,
+	}), "Backoff should be nil")
+	assert.Nil(t, NewBackoff(BackoffConfig{
+		Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Jitter: 1.5,
+	}), "Backoff should be nil")
+}
+
+// Test the delay grows until the maximum and starts again after a reset
+func Test_Backoff_Next(t *testing.T) {
+	b := NewBackoff(BackoffConfig{
+		Initial:    time.Second,
+		Max:        10 * time.Second,
+		Multiplier: 2,
+	})
+
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for _, e := range expected {
+		assert.Equal(t, e*time.Second, b.Next(), "Wrong delay")
+	}
+
+	b.Reset()
+	assert.Equal(t, time.Second, b.Next(), "Wrong delay after reset")
+}
+
+// Test the jitter moves the delay in both directions but not over the maximum
+func Test_Backoff_Jitter(t *testing.T) {
+	config := BackoffConfig{
+		Initial:    10 * time.Second,
+		Max:        12 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+
+	config.Rand = fixedRand(0)
+	assert.Equal(t, 5*time.Second, NewBackoff(config).Next(), "Wrong delay")
+
+	config.Rand = fixedRand(0.5)
+	assert.Equal(t, 10*time.Second, NewBackoff(config).Next(), "Wrong delay")
+
+	config.Rand = fixedRand(0.99)
+	assert.Equal(t, 12*time.Second, NewBackoff(config).Next(), "Wrong delay")
+}
+
+// Test the claim schedule switches to the slow interval after the fast window
+func Test_ClaimSchedule_Next(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := NewClaimSchedule(ClaimScheduleConfig{
+		Fast:    10 * time.Second,
+		FastFor: 30 * time.Second,
+		Slow:    time.Minute,
+		Clock:   clock,
+	})
+
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		d := s.Next()
+		delays = append(delays, d)
+		sleepContext(context.Background(), clock, d)
+	}
+
+	assert.Equal(t, []time.Duration{
+		10 * time.Second, 10 * time.Second, 10 * time.Second, time.Minute, time.Minute,
+	}, delays, "Wrong delays")
+
+	s.Reset()
+	assert.Equal(t, 10*time.Second, s.Next(), "Wrong delay after reset")
+}
+
+// Test waiting is interrupted by a cancelled context
+func Test_SleepContext_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := sleepContext(ctx, realClock{}, time.Hour)
+
+	assert.Equal(t, context.Canceled, err, "Wrong error")
+}
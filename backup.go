@@ -0,0 +1,276 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	backupManifest   = "manifest.json"              // File describing a generation
+	backupTimeFormat = "20060102T150405.000000000Z" // Name of the generations
+	backupDirMode    = 0700                         // Backups hold private keys
+)
+
+// backupEntry describes a file saved on a backup generation
+type backupEntry struct {
+	Path    string      `json:"path"`           // Original location
+	File    string      `json:"file,omitempty"` // Copy inside the generation
+	Mode    os.FileMode `json:"mode"`           // Permissions of the original
+	UID     int         `json:"uid"`            // Owner of the original
+	GID     int         `json:"gid"`            // Group of the original
+	Missing bool        `json:"missing"`        // The file didn't exist
+}
+
+// Backups keeps copies of the files about to be replaced, one directory per
+// generation, so they can be restored if the new ones don't work
+type Backups struct {
+	config BackupConfig
+}
+
+// NewBackups creates a new Backups. It returns nil if the configuration is not
+// valid.
+func NewBackups(config BackupConfig) *Backups {
+	b := &Backups{config: config}
+
+	if b.config.Logger == nil {
+		b.config.Logger = logrus.NewEntry(logrus.New())
+		b.config.Logger.Logger.Out = ioutil.Discard
+	} else {
+		b.config.Logger = b.config.Logger.WithFields(logrus.Fields{
+			"component": "backups",
+		})
+	}
+
+	if len(b.config.Dir) == 0 {
+		b.config.Logger.Warnf("Backup directory not provided")
+		return nil
+	}
+	if b.config.Keep <= 0 {
+		b.config.Logger.Warnf("Number of backups not provided")
+		return nil
+	}
+	if b.config.Clock == nil {
+		b.config.Clock = realClock{}
+	}
+
+	return b
+}
+
+// Save copies the current content of the outputs to a new generation and
+// returns its name. Outputs that don't exist yet are recorded too, so restoring
+// the generation removes them. The oldest generations are removed to keep
+// only the configured number of them.
+func (b *Backups) Save(outputs ...Output) (generation string, err error) {
+	if err := os.MkdirAll(b.config.Dir, backupDirMode); err != nil {
+		return "", err
+	}
+
+	generation = b.config.Clock.Now().UTC().Format(backupTimeFormat)
+
+	// The generation is built apart and renamed when complete, so a partial
+	// generation is never restored
+	tmp, err := ioutil.TempDir(b.config.Dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	var entries []backupEntry
+	for i, out := range outputs {
+		if len(out.Path) == 0 {
+			continue
+		}
+		entry, err := backupFile(out.Path, tmp, strconv.Itoa(i)+"-"+filepath.Base(out.Path))
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, entry)
+	}
+
+	manifest, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, backupManifest), manifest, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(b.config.Dir, generation)); err != nil {
+		return "", err
+	}
+	if err := syncDir(b.config.Dir); err != nil {
+		return "", err
+	}
+
+	b.config.Logger.Debugf("Backup %s saved", generation)
+
+	return generation, b.prune()
+}
+
+// backupFile copies path to name inside dir and describes it
+func backupFile(path, dir, name string) (backupEntry, error) {
+	entry := backupEntry{Path: path, UID: -1, GID: -1}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		entry.Missing = true
+		return entry, nil
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	out := Output{Path: filepath.Join(dir, name), Mode: 0600, UID: -1, GID: -1}
+	if err := out.Write(data); err != nil {
+		return entry, err
+	}
+
+	entry.File = name
+	entry.Mode = info.Mode().Perm()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.UID = int(stat.Uid)
+		entry.GID = int(stat.Gid)
+	}
+
+	return entry, nil
+}
+
+// List returns the names of the generations kept, oldest first
+func (b *Backups) List() ([]string, error) {
+	files, err := ioutil.ReadDir(b.config.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []string
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			generations = append(generations, file.Name())
+		}
+	}
+	sort.Strings(generations)
+
+	return generations, nil
+}
+
+// Latest returns the name of the newest generation
+func (b *Backups) Latest() (string, error) {
+	generations, err := b.List()
+	if err != nil {
+		return "", err
+	}
+	if len(generations) == 0 {
+		return "", errors.New("No backups found on " + b.config.Dir)
+	}
+
+	return generations[len(generations)-1], nil
+}
+
+// Restore puts back the files saved on a generation with their permissions,
+// and removes the ones that didn't exist when it was saved
+func (b *Backups) Restore(generation string) error {
+	_, err := b.restore(generation, true)
+	return err
+}
+
+// RestoreSaved puts back the files saved on a generation with their
+// permissions, keeping the ones that didn't exist when it was saved. It
+// returns if there was any file to restore.
+func (b *Backups) RestoreSaved(generation string) (bool, error) {
+	return b.restore(generation, false)
+}
+
+// restore puts back the files saved on a generation, returning if there was
+// any file to restore. The files missing when it was saved are removed if
+// remove is set.
+func (b *Backups) restore(generation string, remove bool) (bool, error) {
+	if len(generation) == 0 || strings.ContainsAny(generation, `/\`) || strings.HasPrefix(generation, ".") {
+		return false, errors.New("Invalid backup: " + generation)
+	}
+	dir := filepath.Join(b.config.Dir, generation)
+
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, backupManifest))
+	if err != nil {
+		return false, err
+	}
+	var entries []backupEntry
+	if err := json.Unmarshal(manifest, &entries); err != nil {
+		return false, errors.New("Invalid backup manifest: " + err.Error())
+	}
+
+	restored := false
+	for _, entry := range entries {
+		if entry.Missing {
+			if !remove {
+				continue
+			}
+			if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+				return restored, err
+			}
+			b.config.Logger.Debugf("Removed %s", entry.Path)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.File))
+		if err != nil {
+			return restored, err
+		}
+		out := Output{Path: entry.Path, Mode: entry.Mode, UID: entry.UID, GID: entry.GID}
+		if err := out.Write(data); err != nil {
+			return restored, err
+		}
+		restored = true
+		b.config.Logger.Debugf("Restored %s", entry.Path)
+	}
+
+	return restored, nil
+}
+
+// prune removes the oldest generations beyond the configured number
+func (b *Backups) prune() error {
+	generations, err := b.List()
+	if err != nil {
+		return err
+	}
+
+	for len(generations) > b.config.Keep {
+		if err := os.RemoveAll(filepath.Join(b.config.Dir, generations[0])); err != nil {
+			return err
+		}
+		b.config.Logger.Debugf("Backup %s removed", generations[0])
+		generations = generations[1:]
+	}
+
+	return nil
+}
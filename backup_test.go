@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to create backups on a temporary directory
+func testBackups(t *testing.T, keep int) (*Backups, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC)}
+	backups := NewBackups(BackupConfig{
+		Dir:   filepath.Join(t.TempDir(), "backups"),
+		Keep:  keep,
+		Clock: clock,
+	})
+
+	return backups, clock
+}
+
+// Test invalid backup configurations
+func Test_NewBackups_Invalid(t *testing.T) {
+	assert.Nil(t, NewBackups(BackupConfig{Keep: 1}), "Backups should be nil")
+	assert.Nil(t, NewBackups(BackupConfig{Dir: "backups"}), "Backups should be nil")
+}
+
+// Test the saved files are restored with their mode, and the ones that didn't
+// exist are removed
+func Test_Backups_Restore(t *testing.T) {
+	backups, _ := testBackups(t, 5)
+	dir := t.TempDir()
+	cert := Output{Path: filepath.Join(dir, "client.pem"), Mode: 0600, UID: -1, GID: -1}
+	nodename := Output{Path: filepath.Join(dir, "nodename"), Mode: 0644, UID: -1, GID: -1}
+	cert.Write([]byte("old cert"))
+
+	generation, err := backups.Save(cert, nodename)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "20161017T120000.000000000Z", generation, "Wrong generation")
+
+	cert.Mode = 0644
+	cert.Write([]byte("new cert"))
+	nodename.Write([]byte("new node"))
+
+	err = backups.Restore(generation)
+	assert.NoError(t, err, "Unexpected error")
+
+	data, _ := ioutil.ReadFile(cert.Path)
+	assert.Equal(t, "old cert", string(data), "Certificate not restored")
+	info, _ := os.Stat(cert.Path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Mode not restored")
+	_, err = os.Stat(nodename.Path)
+	assert.True(t, os.IsNotExist(err), "Nodename not removed")
+}
+
+// Test the files of a first install are kept when restoring only the saved
+// ones
+func Test_Backups_RestoreSaved(t *testing.T) {
+	backups, _ := testBackups(t, 5)
+	dir := t.TempDir()
+	cert := Output{Path: filepath.Join(dir, "client.pem"), Mode: 0600, UID: -1, GID: -1}
+	nodename := Output{Path: filepath.Join(dir, "nodename"), Mode: 0644, UID: -1, GID: -1}
+
+	generation, err := backups.Save(cert, nodename)
+	assert.NoError(t, err, "Unexpected error")
+	cert.Write([]byte("new cert"))
+	nodename.Write([]byte("new node"))
+
+	restored, err := backups.RestoreSaved(generation)
+	assert.NoError(t, err, "Unexpected error")
+	assert.False(t, restored, "Nothing should be restored")
+	data, _ := ioutil.ReadFile(cert.Path)
+	assert.Equal(t, "new cert", string(data), "Certificate removed")
+	data, _ = ioutil.ReadFile(nodename.Path)
+	assert.Equal(t, "new node", string(data), "Nodename removed")
+}
+
+// Test only the newest generations are kept
+func Test_Backups_Prune(t *testing.T) {
+	backups, clock := testBackups(t, 2)
+	cert := Output{Path: filepath.Join(t.TempDir(), "client.pem"), Mode: 0600, UID: -1, GID: -1}
+
+	var saved []string
+	for i := 0; i < 3; i++ {
+		clock.After(time.Hour)
+		generation, err := backups.Save(cert)
+		assert.NoError(t, err, "Unexpected error")
+		saved = append(saved, generation)
+	}
+
+	generations, err := backups.List()
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, saved[1:], generations, "Wrong generations")
+
+	latest, err := backups.Latest()
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, saved[2], latest, "Wrong latest generation")
+}
+
+// Test unknown and malicious generations are rejected
+func Test_Backups_Restore_Invalid(t *testing.T) {
+	backups, _ := testBackups(t, 5)
+
+	assert.Error(t, backups.Restore("20161017T120000.000000000Z"), "Expected error")
+	assert.Error(t, backups.Restore("../backups"), "Expected error")
+	assert.Error(t, backups.Restore(""), "Expected error")
+
+	_, err := backups.Latest()
+	assert.Error(t, err, "Expected error")
+}
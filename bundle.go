@@ -0,0 +1,276 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Version of the format of the bundles made by export
+const bundleVersion = 1
+
+// Encryption of the bundles protected with a passphrase. The key is derived
+// with scrypt using the recommended cost for interactive logins.
+const (
+	bundleKDF      = "scrypt"
+	bundleCipher   = "aes-256-gcm"
+	bundleScryptN  = 1 << 15
+	bundleScryptR  = 8
+	bundleScryptP  = 1
+	bundleKeySize  = 32
+	bundleSaltSize = 16
+)
+
+// Files that make up the identity of a device, named after the flag that sets
+// their path
+const (
+	bundleCertFile      = "cert"
+	bundleKeyOutFile    = "key-out"
+	bundleCertOutFile   = "cert-out"
+	bundleCAOutFile     = "ca-out"
+	bundleNodenameFile  = "nodename"
+	bundleEnrollKeyFile = "enroll-key"
+	bundleHashFile      = "hash-file"
+)
+
+// Bundle is everything needed to move the identity of a device to a
+// replacement: the content of the database and the files written on the claim
+type Bundle struct {
+	Hash       string            `json:"hash"`             // Hash of the exported device
+	ExportedAt time.Time         `json:"exported_at"`      // Time of the export
+	Identities []Identity        `json:"identities"`       // UUIDs issued by the managers
+	States     []*State          `json:"states"`           // Registration states
+	Events     []Event           `json:"events,omitempty"` // History, oldest first
+	Files      map[string][]byte `json:"files"`            // Content of the files by name
+}
+
+// bundleFile is the versioned envelope of a bundle. The bundle is kept as is
+// or, if encrypted, on the ciphertext.
+type bundleFile struct {
+	Version    int               `json:"version"`
+	Encryption *bundleEncryption `json:"encryption,omitempty"`
+	Bundle     *Bundle           `json:"bundle,omitempty"`
+	Ciphertext []byte            `json:"ciphertext,omitempty"`
+}
+
+// bundleEncryption holds the parameters needed to decrypt a bundle besides
+// the passphrase
+type bundleEncryption struct {
+	KDF    string `json:"kdf"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Salt   []byte `json:"salt"`
+	Cipher string `json:"cipher"`
+	Nonce  []byte `json:"nonce"`
+}
+
+// encodeBundle serialises a bundle, encrypted with the passphrase if there is
+// one
+func encodeBundle(bundle *Bundle, passphrase string) ([]byte, error) {
+	file := bundleFile{Version: bundleVersion}
+	if len(passphrase) == 0 {
+		file.Bundle = bundle
+		return json.MarshalIndent(file, "", "  ")
+	}
+
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	file.Encryption = &bundleEncryption{
+		KDF:    bundleKDF,
+		N:      bundleScryptN,
+		R:      bundleScryptR,
+		P:      bundleScryptP,
+		Salt:   make([]byte, bundleSaltSize),
+		Cipher: bundleCipher,
+	}
+	if _, err := rand.Read(file.Encryption.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := bundleAEAD(file.Encryption, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	file.Encryption.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Encryption.Nonce); err != nil {
+		return nil, err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Encryption.Nonce, plaintext, bundleAdditionalData(file.Version))
+
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// decodeBundle parses a bundle, decrypting it with the passphrase if it is
+// encrypted. The content is not validated.
+func decodeBundle(data []byte, passphrase string) (*Bundle, error) {
+	var file bundleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Invalid bundle: %v", err)
+	}
+	if file.Version < 1 || file.Version > bundleVersion {
+		return nil, fmt.Errorf("Bundle version %d is not supported, the latest is %d", file.Version, bundleVersion)
+	}
+
+	if file.Encryption == nil {
+		if file.Bundle == nil {
+			return nil, errors.New("Invalid bundle: no content")
+		}
+		return file.Bundle, nil
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("The bundle is encrypted, a passphrase is needed")
+	}
+	aead, err := bundleAEAD(file.Encryption, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Encryption.Nonce) != aead.NonceSize() {
+		return nil, errors.New("Invalid bundle: wrong nonce size")
+	}
+	plaintext, err := aead.Open(nil, file.Encryption.Nonce, file.Ciphertext, bundleAdditionalData(file.Version))
+	if err != nil {
+		return nil, errors.New("Wrong passphrase or damaged bundle")
+	}
+
+	bundle := &Bundle{}
+	if err := json.Unmarshal(plaintext, bundle); err != nil {
+		return nil, fmt.Errorf("Invalid bundle: %v", err)
+	}
+
+	return bundle, nil
+}
+
+// bundleAEAD derives the key from the passphrase and returns the cipher
+func bundleAEAD(encryption *bundleEncryption, passphrase string) (cipher.AEAD, error) {
+	if encryption.KDF != bundleKDF || encryption.Cipher != bundleCipher {
+		return nil, fmt.Errorf("Unsupported bundle encryption: %s/%s", encryption.KDF, encryption.Cipher)
+	}
+	// The cost is taken from the file, so only the one used on export is
+	// accepted. A larger one could take hours or gigabytes to derive the key.
+	if encryption.N != bundleScryptN || encryption.R != bundleScryptR || encryption.P != bundleScryptP {
+		return nil, fmt.Errorf("Unsupported bundle encryption cost: N=%d r=%d p=%d", encryption.N, encryption.R, encryption.P)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), encryption.Salt, encryption.N, encryption.R, encryption.P, bundleKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bundle encryption: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// bundleAdditionalData binds the ciphertext to the version of the bundle
+func bundleAdditionalData(version int) []byte {
+	return []byte("rb-register bundle v" + strconv.Itoa(version))
+}
+
+// Validate checks the bundle holds the registration of its hash and that the
+// files are consistent with it: the certificate must be the one installed
+// when the state was saved, and issued to the nodename.
+func (b *Bundle) Validate() error {
+	if len(b.Hash) == 0 {
+		return errors.New("No hash found")
+	}
+
+	var state *State
+	for _, s := range b.States {
+		if len(s.Hash) == 0 {
+			return errors.New("State without hash found")
+		}
+		if !validStatus(s.Status) {
+			return fmt.Errorf("Unknown status of %s: %q", s.Hash, s.Status)
+		}
+		if s.Hash == b.Hash {
+			state = s
+		}
+	}
+	found := state != nil
+	for _, identity := range b.Identities {
+		if len(identity.Hash) == 0 || len(identity.UUID) == 0 {
+			return errors.New("Incomplete identity found")
+		}
+		found = found || identity.Hash == b.Hash
+	}
+	if !found {
+		return errors.New("No registration found for " + b.Hash)
+	}
+
+	for name := range b.Files {
+		if !validBundleFile(name) {
+			return errors.New("Unknown file: " + name)
+		}
+	}
+
+	// Devices registered before the certificates were issued keep only the
+	// private key, as received from the manager
+	if data, ok := b.Files[bundleCertFile]; ok && bytes.Contains(data, []byte("-----BEGIN CERTIFICATE")) {
+		creds, err := parseCredentials(data)
+		if err != nil {
+			return fmt.Errorf("Invalid certificate: %v", err)
+		}
+		if state != nil && len(state.Fingerprint) > 0 && state.Fingerprint != creds.Fingerprint() {
+			return errors.New("The certificate is not the one installed on the claim")
+		}
+		nodename := strings.TrimSpace(string(b.Files[bundleNodenameFile]))
+		// Enrolled certificates may be issued to the subject of the CSR, the hash
+		if cn := creds.Certs[0].Subject.CommonName; len(nodename) > 0 && cn != nodename && cn != b.Hash {
+			return fmt.Errorf("Certificate issued to %q instead of %q", cn, nodename)
+		}
+	}
+
+	return nil
+}
+
+// validStatus checks if a status is one of the registration statuses
+func validStatus(status string) bool {
+	switch status {
+	case stateRegistering, stateRegistered, stateClaimed, stateProvisioned:
+		return true
+	}
+
+	return false
+}
+
+// validBundleFile checks if a file name is one of the files of a bundle
+func validBundleFile(name string) bool {
+	switch name {
+	case bundleCertFile, bundleKeyOutFile, bundleCertOutFile, bundleCAOutFile,
+		bundleNodenameFile, bundleEnrollKeyFile, bundleHashFile:
+		return true
+	}
+
+	return false
+}
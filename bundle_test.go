@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to create a bundle of a claimed device
+func testExportBundle(t *testing.T) *Bundle {
+	key, _ := generateKey(ecdsaKey, 256)
+	cert := testBundle(t, key, "node", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	creds, err := parseCredentials(cert)
+	assert.NoError(t, err, "Unexpected error")
+
+	state := newState("hash")
+	state.UUID = "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"
+	state.Manager = "https://manager"
+	state.Nodename = "node"
+	state.Fingerprint = creds.Fingerprint()
+	state.Transition(stateClaimed, time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC))
+
+	return &Bundle{
+		Hash:       "hash",
+		ExportedAt: time.Date(2016, 10, 18, 12, 0, 0, 0, time.UTC),
+		Identities: []Identity{{Manager: state.Manager, Hash: "hash", UUID: state.UUID}},
+		States:     []*State{state},
+		Files: map[string][]byte{
+			bundleCertFile:     cert,
+			bundleNodenameFile: []byte("node"),
+			bundleHashFile:     []byte("hash\n"),
+		},
+	}
+}
+
+// Test bundles are decoded as encoded, with and without passphrase
+func Test_Bundle_Encode(t *testing.T) {
+	bundle := testExportBundle(t)
+
+	for _, passphrase := range []string{"", "secret"} {
+		data, err := encodeBundle(bundle, passphrase)
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, len(passphrase) == 0, strings.Contains(string(data), bundle.States[0].UUID), "Wrong encryption")
+
+		decoded, err := decodeBundle(data, passphrase)
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, bundle.Files, decoded.Files, "Wrong files")
+		assert.Equal(t, bundle.Identities, decoded.Identities, "Wrong identities")
+		if assert.Len(t, decoded.States, 1, "Wrong states") {
+			assert.Equal(t, stateClaimed, decoded.States[0].Status, "Wrong status")
+		}
+		assert.NoError(t, decoded.Validate(), "Unexpected error")
+	}
+}
+
+// Test encrypted bundles are not decoded without the right passphrase
+func Test_Bundle_Decode_Invalid(t *testing.T) {
+	data, err := encodeBundle(testExportBundle(t), "secret")
+	assert.NoError(t, err, "Unexpected error")
+
+	_, err = decodeBundle(data, "")
+	assert.Error(t, err, "Expected error")
+	_, err = decodeBundle(data, "wrong")
+	assert.Error(t, err, "Expected error")
+	_, err = decodeBundle([]byte(`{"version": 99, "bundle": {}}`), "")
+	assert.Error(t, err, "Expected error")
+	_, err = decodeBundle([]byte(`not a bundle`), "")
+	assert.Error(t, err, "Expected error")
+
+	// A crafted cost is rejected before deriving the key
+	var file bundleFile
+	json.Unmarshal(data, &file)
+	file.Encryption.N = 1 << 30
+	data, _ = json.Marshal(file)
+	_, err = decodeBundle(data, "secret")
+	if assert.Error(t, err, "Expected error") {
+		assert.Contains(t, err.Error(), "cost", "Wrong error")
+	}
+}
+
+// Test bundles not holding a consistent registration are rejected
+func Test_Bundle_Validate_Invalid(t *testing.T) {
+	bundle := testExportBundle(t)
+	bundle.Hash = "other"
+	assert.Error(t, bundle.Validate(), "Expected error")
+
+	bundle = testExportBundle(t)
+	bundle.States[0].Status = "unknown"
+	assert.Error(t, bundle.Validate(), "Expected error")
+
+	bundle = testExportBundle(t)
+	bundle.States[0].Fingerprint = "0000"
+	assert.Error(t, bundle.Validate(), "Expected error")
+
+	bundle = testExportBundle(t)
+	bundle.Files[bundleNodenameFile] = []byte("other")
+	assert.Error(t, bundle.Validate(), "Expected error")
+
+	bundle = testExportBundle(t)
+	bundle.Files["passwd"] = []byte("root")
+	assert.Error(t, bundle.Validate(), "Expected error")
+}
+
+// Test certificates enrolled with a CSR signed as submitted are accepted
+func Test_Bundle_Validate_Enrolled(t *testing.T) {
+	bundle := testExportBundle(t)
+	key, _ := generateKey(ecdsaKey, 256)
+	cert := testBundle(t, key, "hash", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	creds, _ := parseCredentials(cert)
+	bundle.States[0].Fingerprint = creds.Fingerprint()
+	bundle.Files[bundleCertFile] = cert
+
+	assert.NoError(t, bundle.Validate(), "Unexpected error")
+}
+
+// Test the private key of devices registered before the certificates were
+// issued is accepted as the certificate
+func Test_Bundle_Validate_Key_Only(t *testing.T) {
+	bundle := testExportBundle(t)
+	bundle.States[0].Fingerprint = ""
+	bundle.Files[bundleCertFile] = []byte(certificate)
+
+	assert.NoError(t, bundle.Validate(), "Unexpected error")
+}
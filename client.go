@@ -18,32 +18,60 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto"
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	registerRequest    = "register"
-	verifyRequest      = "verify"
-	claimedResponse    = "claimed"
-	registeredResponse = "registered"
+	registerRequest      = "register"
+	verifyRequest        = "verify"
+	renewRequest         = "renew"
+	deregisterRequest    = "deregister"
+	claimedResponse      = "claimed"
+	registeredResponse   = "registered"
+	deregisteredResponse = "deregistered"
 )
 
+// Longest Retry-After honored if none is configured, the default -sleep
+const defaultMaxRetryAfter = 5 * time.Minute
+
 // APIClient is an objet that can communicate with the API to perform a
 // registration. It has the necessary methods to interact with the API.
 type APIClient struct {
 	status   string // Current status of the registrtation
 	cert     string // Client certificate
+	key      string // Private key, if sent apart from the certificate
+	chain    string // Intermediate certificates
+	ca       string // CA certificate of the manager
+	encoding string // Encoding of the key and the certificates
 	nodename string // Name of the node received along with the cert
 
+	endpoints []*endpoint // Manager URLs in priority order
+	pinned    *endpoint   // Manager that issued the UUID
+
+	signingKey crypto.PublicKey // Key of the manager signing the responses
+
 	config APIClientConfig
 }
 
+// Claim is the material sent by the API once the device is claimed. Old
+// managers only send Cert, holding both the private key and the certificate.
+type Claim struct {
+	Cert     string // Certificate, may be preceded by the private key
+	Key      string // Private key, if sent apart from the certificate
+	Chain    string // Intermediate certificates
+	CA       string // CA certificate of the manager
+	Encoding string // Encoding of the key and the certificates, guessed if empty
+	Nodename string // Name of the node
+}
+
 // NewAPIClient creates a new instance of an ApiClient object
 func NewAPIClient(config APIClientConfig) *APIClient {
 	c := &APIClient{
@@ -63,7 +91,8 @@ func NewAPIClient(config APIClientConfig) *APIClient {
 	logger := c.config.Logger
 
 	// Check if the configuration is ok
-	if len(c.config.URL) == 0 {
+	c.endpoints = newEndpoints(append([]string{c.config.URL}, c.config.URLs...)...)
+	if len(c.endpoints) == 0 {
 		logger.Warnf("Url not provided")
 		return nil
 	}
@@ -83,15 +112,35 @@ func NewAPIClient(config APIClientConfig) *APIClient {
 		logger.Warnf("Device type not provided")
 		return nil
 	}
+	if c.config.Clock == nil {
+		c.config.Clock = realClock{}
+	}
+	if c.config.EndpointCooldown == 0 {
+		c.config.EndpointCooldown = defaultEndpointCooldown
+	}
+	if c.config.MaxRetryAfter == 0 {
+		c.config.MaxRetryAfter = defaultMaxRetryAfter
+	}
 	if c.config.HTTPClient == nil {
-		if c.config.Insecure {
-			c.config.HTTPClient = &http.Client{Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}}
-		} else {
-			c.config.HTTPClient = &http.Client{}
+		transport, err := newTransport(c.config)
+		if err != nil {
+			logger.Warnf("Invalid transport configuration: %s", err)
+			return nil
+		}
+		c.config.HTTPClient = &http.Client{Transport: transport}
+
+		if len(c.config.Proxy) > 0 {
+			logger.Infof("Using proxy %s", redactURL(c.config.Proxy))
 		}
 	}
+	if len(c.config.SigningKeyFile) > 0 {
+		key, err := loadSigningKey(c.config.SigningKeyFile)
+		if err != nil {
+			logger.Warnf("Invalid signing key: %s", err)
+			return nil
+		}
+		c.signingKey = key
+	}
 
 	return c
 }
@@ -99,10 +148,16 @@ func NewAPIClient(config APIClientConfig) *APIClient {
 // Register send a POST request with some fields to the remote API. It expects
 // a UUID from the API.
 func (c *APIClient) Register() (uuid string, err error) {
+	return c.RegisterContext(context.Background())
+}
+
+// RegisterContext is like Register but the request is bound to ctx, so it can
+// be cancelled or given a deadline by the caller.
+func (c *APIClient) RegisterContext(ctx context.Context) (uuid string, err error) {
 	logger := c.config.Logger
 
 	if c.status == registeredResponse {
-		return "", errors.New("This device is already registered")
+		return "", ErrAlreadyRegistered
 	}
 
 	// request structure for register method
@@ -130,60 +185,39 @@ func (c *APIClient) Register() (uuid string, err error) {
 		Hash:       c.config.Hash,
 	}
 
-	// Generate a JSON message with the request
-	marshalledReq, err := json.Marshal(&req)
-	if err != nil {
-		return "", err
-	}
-
 	// Send request
 	logger.Debugf("Register request: %v", req)
-	bufferReq := bytes.NewBuffer(marshalledReq)
-	httpReq, err := http.NewRequest("POST", c.config.URL, bufferReq)
-	if err != nil {
-		return "", err
-	}
-	httpReq.Header.Set("Content-Type", "application/json")
-
-	rawResponse, err := c.config.HTTPClient.Do(httpReq)
-	if err != nil {
-		return "", err
-	}
-	defer rawResponse.Body.Close()
-	if rawResponse.StatusCode >= 400 {
-		return "", errors.New("Got status code: " + rawResponse.Status)
-	}
-
-	// Read response to a buffer
-	bufferResponse, err := ioutil.ReadAll(rawResponse.Body)
-	if err != nil {
-		return "", err
-	}
-
-	// Unmarshall the response
 	res := Response{}
-	err = json.Unmarshal(bufferResponse, &res)
+	e, err := c.send(ctx, &req, &res)
 	if err != nil {
 		return "", err
 	}
 
-	logger.Debugf("Register response: %v", res)
+	logger.Debugf("Register response from %s: %v", e.url, res)
 
-	// Check response
+	// Check response. The UUID is only valid on the manager that issued it
 	if res.Status == registeredResponse {
 		c.status = res.Status
+		c.pinned = e
 	}
 
 	return res.UUID, nil
 }
 
 // Verify send the UUID along with the HASH to the API and expect to receive
-// a client certificate
+// a client certificate. If the client has a CSR it is sent too, so the API can
+// sign it instead of generating a new key.
 func (c *APIClient) Verify(uuid string) error {
+	return c.VerifyContext(context.Background(), uuid)
+}
+
+// VerifyContext is like Verify but the request is bound to ctx, so it can be
+// cancelled or given a deadline by the caller.
+func (c *APIClient) VerifyContext(ctx context.Context, uuid string) error {
 	logger := c.config.Logger
 
 	if c.status == claimedResponse {
-		return errors.New("This device is already claimed")
+		return ErrAlreadyClaimed
 	}
 
 	// request structure for register method
@@ -191,13 +225,18 @@ func (c *APIClient) Verify(uuid string) error {
 		Order string `json:"order"`
 		Hash  string `json:"hash"`
 		UUID  string `json:"uuid"`
+		CSR   string `json:"csr,omitempty"`
 	}
 
 	// response structure for register method
 	type response struct {
-		Status   string `json:"status"`
-		Cert     string `json:"cert"`
-		Nodename string `json:"nodename"`
+		Status       string `json:"status"`
+		Cert         string `json:"cert"`
+		Key          string `json:"key"`
+		Chain        string `json:"chain"`
+		CA           string `json:"ca"`
+		CertEncoding string `json:"cert_encoding"`
+		Nodename     string `json:"nodename"`
 	}
 
 	// Build the request
@@ -205,6 +244,151 @@ func (c *APIClient) Verify(uuid string) error {
 		Order: "verify",
 		Hash:  c.config.Hash,
 		UUID:  uuid,
+		CSR:   c.config.CSR,
+	}
+
+	// Send request
+	logger.Debugf("Verify request: %v", req)
+	res := response{}
+	if _, err := c.send(ctx, &req, &res); err != nil {
+		return err
+	}
+
+	logger.Debugf("Claimed response: %v", res)
+
+	if res.Status == registeredResponse {
+		return nil
+	}
+
+	if res.Status == claimedResponse {
+		c.nodename = res.Nodename
+		c.status = res.Status
+		c.cert = res.Cert
+		c.key = res.Key
+		c.chain = res.Chain
+		c.ca = res.CA
+		c.encoding = res.CertEncoding
+
+		return nil
+	}
+
+	return &UnknownStatusError{Status: res.Status}
+}
+
+// RenewContext asks the API for a new certificate before the current one
+// expires. The client must present the current certificate over mTLS as proof
+// of identity. If csr is given the API signs it, otherwise it sends a new key
+// along with the certificate.
+func (c *APIClient) RenewContext(ctx context.Context, uuid, csr string) (Claim, error) {
+	logger := c.config.Logger
+
+	// request structure for renew method
+	type request struct {
+		Order string `json:"order"`
+		Hash  string `json:"hash"`
+		UUID  string `json:"uuid"`
+		CSR   string `json:"csr,omitempty"`
+	}
+
+	// response structure for renew method
+	type response struct {
+		Status       string `json:"status"`
+		Cert         string `json:"cert"`
+		Key          string `json:"key"`
+		Chain        string `json:"chain"`
+		CA           string `json:"ca"`
+		CertEncoding string `json:"cert_encoding"`
+		Nodename     string `json:"nodename"`
+	}
+
+	// Build the request
+	req := request{
+		Order: renewRequest,
+		Hash:  c.config.Hash,
+		UUID:  uuid,
+		CSR:   csr,
+	}
+
+	// Send request
+	logger.Debugf("Renew request: %v", req)
+	res := response{}
+	if _, err := c.send(ctx, &req, &res); err != nil {
+		return Claim{}, err
+	}
+
+	logger.Debugf("Renew response: %v", res)
+
+	if res.Status != claimedResponse {
+		return Claim{}, &UnknownStatusError{Status: res.Status}
+	}
+
+	return Claim{
+		Cert:     res.Cert,
+		Key:      res.Key,
+		Chain:    res.Chain,
+		CA:       res.CA,
+		Encoding: res.CertEncoding,
+		Nodename: res.Nodename,
+	}, nil
+}
+
+// DeregisterContext tells the API the device is out of service, so it is
+// removed from the manager. The client certificate, if configured, is
+// presented over mTLS as proof of identity.
+func (c *APIClient) DeregisterContext(ctx context.Context, uuid string) error {
+	logger := c.config.Logger
+
+	// request structure for deregister method
+	type request struct {
+		Order string `json:"order"`
+		Hash  string `json:"hash"`
+		UUID  string `json:"uuid"`
+	}
+
+	// response structure for deregister method
+	type response struct {
+		Status string `json:"status"`
+	}
+
+	// Build the request
+	req := request{
+		Order: deregisterRequest,
+		Hash:  c.config.Hash,
+		UUID:  uuid,
+	}
+
+	// Send request
+	logger.Debugf("Deregister request: %v", req)
+	res := response{}
+	if _, err := c.send(ctx, &req, &res); err != nil {
+		return err
+	}
+
+	logger.Debugf("Deregister response: %v", res)
+
+	if res.Status != deregisteredResponse {
+		return &UnknownStatusError{Status: res.Status}
+	}
+
+	c.status = res.Status
+	c.cert = ""
+	c.key = ""
+	c.chain = ""
+	c.ca = ""
+	c.encoding = ""
+	c.nodename = ""
+
+	return nil
+}
+
+// post sends req as a JSON message to the API on url and decodes the JSON
+// response into res. If the client has a timeout configured the request is
+// aborted once it expires.
+func (c *APIClient) post(ctx context.Context, url string, req, res interface{}) (err error) {
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
 	}
 
 	// Generate a JSON message with the request
@@ -213,10 +397,15 @@ func (c *APIClient) Verify(uuid string) error {
 		return err
 	}
 
-	// Send request
-	logger.Debugf("Verify request: %v", req)
+	// Keep the request and its outcome on the history
+	event := Event{Time: c.config.Clock.Now(), Hash: c.config.Hash, Manager: url}
+	if c.config.History != nil {
+		event.Order = decodeFields(marshalledReq).Order
+		defer func() { c.recordEvent(event, err) }()
+	}
+
 	bufferReq := bytes.NewBuffer(marshalledReq)
-	httpReq, err := http.NewRequest("POST", c.config.URL, bufferReq)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bufferReq)
 	if err != nil {
 		return err
 	}
@@ -227,8 +416,17 @@ func (c *APIClient) Verify(uuid string) error {
 		return err
 	}
 	defer rawResponse.Body.Close()
+	event.HTTPStatus = rawResponse.StatusCode
 	if rawResponse.StatusCode >= 400 {
-		return errors.New("Got status code: " + rawResponse.Status)
+		statusErr := newHTTPStatusError(rawResponse)
+		if isRetryableStatus(rawResponse.StatusCode) {
+			return &RetryableError{
+				HTTPStatusError: statusErr,
+				RetryAfter: parseRetryAfter(rawResponse.Header.Get("Retry-After"), c.config.Clock.Now(),
+					c.config.MaxRetryAfter),
+			}
+		}
+		return statusErr
 	}
 
 	// Read response to a buffer
@@ -237,28 +435,57 @@ func (c *APIClient) Verify(uuid string) error {
 		return err
 	}
 
-	// Unmarshall the response
-	res := response{}
-	err = json.Unmarshal(bufferResponse, &res)
-	if err != nil {
-		return err
+	event.Status = decodeFields(bufferResponse).Status
+
+	// The body is only trusted if the manager signed it
+	if c.signingKey != nil {
+		jws := rawResponse.Header.Get(signatureHeader)
+		if err := verifyDetachedJWS(jws, bufferResponse, c.signingKey); err != nil {
+			return err
+		}
 	}
 
-	logger.Debugf("Claimed response: %v", res)
+	// Unmarshall the response
+	return json.Unmarshal(bufferResponse, res)
+}
 
-	if res.Status == registeredResponse {
-		return nil
-	}
+// exchangeFields are the fields common to every request and response
+type exchangeFields struct {
+	Order  string `json:"order"`
+	Status string `json:"status"`
+}
 
-	if res.Status == claimedResponse {
-		c.nodename = res.Nodename
-		c.status = res.Status
-		c.cert = res.Cert
+// decodeFields decodes the common fields of a request or a response, leaving
+// them empty if they can't be decoded
+func decodeFields(data []byte) (fields exchangeFields) {
+	json.Unmarshal(data, &fields)
+	return
+}
 
-		return nil
+// recordEvent adds a request to the history along with its outcome
+func (c *APIClient) recordEvent(event Event, err error) {
+	event.Latency = c.config.Clock.Now().Sub(event.Time)
+	if err != nil {
+		event.Error = err.Error()
 	}
 
-	return errors.New("Unknow status: " + res.Status)
+	if err := c.config.History.AddEvent(event); err != nil {
+		c.config.Logger.Warnf("Error recording request: %v", err)
+	}
+}
+
+// RejectClaim discards the material received when the device was claimed, so
+// it is requested again on the next verify
+func (c *APIClient) RejectClaim() {
+	if c.status == claimedResponse {
+		c.status = registeredResponse
+		c.cert = ""
+		c.key = ""
+		c.chain = ""
+		c.ca = ""
+		c.encoding = ""
+		c.nodename = ""
+	}
 }
 
 // IsRegistered check if the client has been registered previously
@@ -276,7 +503,59 @@ func (c *APIClient) GetCertificate() string {
 	return c.cert
 }
 
+// GetClaim returns all the material received if the device is claimed
+func (c *APIClient) GetClaim() Claim {
+	return Claim{
+		Cert:     c.cert,
+		Key:      c.key,
+		Chain:    c.chain,
+		CA:       c.ca,
+		Encoding: c.encoding,
+		Nodename: c.nodename,
+	}
+}
+
 // GetNodename return the certificate if the device is claimed
 func (c *APIClient) GetNodename() string {
 	return c.nodename
 }
+
+// isRetryableStatus checks if the status code means the API is temporarily
+// unable to attend the request
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// parseRetryAfter decodes a Retry-After header, which can be given either as
+// a number of seconds or as an HTTP date. It returns zero if the header is
+// missing or malformed, and max if it asks to wait longer.
+func parseRetryAfter(value string, now time.Time, max time.Duration) time.Duration {
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds > 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+		if seconds > int(max/time.Second) {
+			delay = max
+		}
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	}
+
+	switch {
+	case delay < 0:
+		return 0
+	case delay > max:
+		return max
+	}
+
+	return delay
+}
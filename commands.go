@@ -0,0 +1,591 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newBackups creates the backups configured on the command line, or nil if
+// they are disabled
+func newBackups() *Backups {
+	if *backupKeep <= 0 {
+		return nil
+	}
+
+	return NewBackups(BackupConfig{
+		Dir:    *backupDir,
+		Keep:   *backupKeep,
+		Clock:  clock,
+		Logger: logrus.NewEntry(logger),
+	})
+}
+
+// openStateStore opens the database configured on the command line. A read
+// only database can be shared with a running service.
+func openStateStore(readOnly bool) (StateStore, error) {
+	return newStateStore(*dbDriver, StoreConfig{
+		Path:     *dbFile,
+		ReadOnly: readOnly,
+		History: HistoryRetention{
+			Keep: *historyKeep,
+			Age:  time.Duration(*historyDays) * 24 * time.Hour,
+		},
+		Logger: logger,
+	})
+}
+
+// rollbackCommand restores the credentials saved on a backup, the newest one
+// if none is given. It returns the exit status.
+func rollbackCommand(args []string) int {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	list := flags.Bool("list", false, "List the backups kept, oldest first")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: rb_register [options] rollback [-list] [backup]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	backups := NewBackups(BackupConfig{
+		Dir:    *backupDir,
+		Keep:   1,
+		Logger: logrus.NewEntry(logger),
+	})
+	if backups == nil {
+		logger.Errorln("Invalid backup configuration")
+		return 1
+	}
+
+	if *list {
+		generations, err := backups.List()
+		if err != nil {
+			logger.Errorf("Error listing backups: %v", err)
+			return 1
+		}
+		for _, generation := range generations {
+			fmt.Fprintln(os.Stdout, generation)
+		}
+		return 0
+	}
+
+	generation := flags.Arg(0)
+	if len(generation) == 0 {
+		var err error
+		if generation, err = backups.Latest(); err != nil {
+			logger.Errorln(err)
+			return 1
+		}
+	}
+
+	if err := backups.Restore(generation); err != nil {
+		logger.Errorf("Error restoring backup %s: %v", generation, err)
+		return 1
+	}
+	logger.Infof("Backup %s restored", generation)
+
+	return 0
+}
+
+// deregisterCommand tells the manager the device is out of service and removes
+// its local state: the UUID from the database and the given files. With
+// -local-only the manager is not notified. It returns the exit status.
+func deregisterCommand(ctx context.Context, args []string, config APIClientConfig, files []Output) int {
+	flags := flag.NewFlagSet("deregister", flag.ContinueOnError)
+	localOnly := flags.Bool("local-only", false, "Only remove the local state, without notifying the manager")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: rb_register [options] deregister [-local-only]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var db StateStore
+	state := newState(*hash)
+	if len(*dbFile) > 0 {
+		var err error
+		if db, err = openStateStore(false); err != nil {
+			logger.Errorln(err)
+			return 1
+		}
+		defer db.Close()
+		config.History = db
+
+		if state, err = loadState(db, config.URLs); err != nil {
+			logger.Errorf("Error loading state: %v", err)
+			return 1
+		}
+	}
+
+	if !*localOnly {
+		if len(state.UUID) == 0 {
+			logger.Errorln("UUID not found, use -local-only to remove the local state")
+			return 1
+		}
+		if err := deregisterDevice(ctx, state, config); err != nil {
+			logger.Errorf("Deregister failed: %v", err)
+			return 1
+		}
+		logger.Infoln("Device deregistered from the manager")
+	}
+
+	// Keep the credentials so they can be restored with rollback
+	if backups := newBackups(); backups != nil {
+		generation, err := backups.Save(files...)
+		if err != nil {
+			logger.Errorf("Error saving backup: %v", err)
+			return 1
+		}
+		logger.Infof("Credentials saved on backup %s", generation)
+	}
+
+	status := 0
+	if db != nil {
+		if err := deleteIdentities(db, *hash); err != nil {
+			logger.Errorf("Error removing UUID: %v", err)
+			status = 1
+		}
+		if err := db.DeleteState(*hash); err != nil {
+			logger.Errorf("Error removing state: %v", err)
+			status = 1
+		}
+	}
+	for _, file := range files {
+		if len(file.Path) == 0 {
+			continue
+		}
+		if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("Error removing %s: %v", file.Path, err)
+			status = 1
+			continue
+		}
+		logger.Debugf("Removed %s", file.Path)
+	}
+
+	return status
+}
+
+// deleteIdentities removes the UUIDs issued by every manager for a hash
+func deleteIdentities(db StateStore, hash string) error {
+	identities, err := db.ListIdentities()
+	if err != nil {
+		return err
+	}
+
+	for _, identity := range identities {
+		if identity.Hash != hash {
+			continue
+		}
+		if err := db.DeleteUUID(identity.Manager, identity.Hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// historyCommand prints the requests sent to the API, oldest first, as a table
+// or as JSON. It returns the exit status.
+func historyCommand(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print the requests as JSON")
+	limit := flags.Int("n", 50, "Number of requests to print, the newest ones (0 for all)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: rb_register [options] history [-json] [-n requests]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if len(*dbFile) == 0 {
+		logger.Errorln("No database given, the history is kept on -db")
+		return 1
+	}
+	db, err := openStateStore(true)
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+	defer db.Close()
+
+	events, err := db.LoadEvents(*limit)
+	if err != nil {
+		logger.Errorf("Error loading history: %v", err)
+		return 1
+	}
+
+	if *asJSON {
+		err = printEventsJSON(os.Stdout, events)
+	} else {
+		err = printEvents(os.Stdout, events)
+	}
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+
+	return 0
+}
+
+// printEvents writes the events as a table
+func printEvents(w io.Writer, events []Event) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tORDER\tMANAGER\tHTTP\tSTATUS\tLATENCY\tERROR")
+	for _, event := range events {
+		httpStatus := "-"
+		if event.HTTPStatus > 0 {
+			httpStatus = strconv.Itoa(event.HTTPStatus)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\t%s\n", event.Time.Format(time.RFC3339), event.Order,
+			event.Manager, httpStatus, event.Status, event.Latency.Round(time.Millisecond), event.Error)
+	}
+
+	return tw.Flush()
+}
+
+// printEventsJSON writes the events as a JSON array
+func printEventsJSON(w io.Writer, events []Event) error {
+	if events == nil {
+		events = []Event{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(events)
+}
+
+// exportCommand saves the registration of the device, along with the files
+// written on the claim, on a bundle that can be imported on a replacement. It
+// returns the exit status.
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	passphraseFile := flags.String("passphrase-file", "", "File holding the passphrase to encrypt the bundle with")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: rb_register [options] export [-passphrase-file file] <bundle>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if len(*dbFile) == 0 {
+		logger.Errorln("No database given, the registration is kept on -db")
+		return 1
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		logger.Errorf("Error reading passphrase: %v", err)
+		return 1
+	}
+	files, err := bundleOutputs()
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+	db, err := openStateStore(true)
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+	defer db.Close()
+
+	bundle := &Bundle{Hash: *hash, ExportedAt: clock.Now(), Files: make(map[string][]byte)}
+	if bundle.Identities, err = db.ListIdentities(); err != nil {
+		logger.Errorf("Error loading UUIDs: %v", err)
+		return 1
+	}
+	if bundle.States, err = db.ListStates(); err != nil {
+		logger.Errorf("Error loading states: %v", err)
+		return 1
+	}
+	if bundle.Events, err = db.LoadEvents(0); err != nil {
+		logger.Errorf("Error loading history: %v", err)
+		return 1
+	}
+	for name, file := range files {
+		if len(file.Path) == 0 {
+			continue
+		}
+		data, err := ioutil.ReadFile(file.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			logger.Errorln(err)
+			return 1
+		}
+		bundle.Files[name] = data
+	}
+	if err := bundle.Validate(); err != nil {
+		logger.Errorf("Nothing valid to export: %v", err)
+		return 1
+	}
+
+	data, err := encodeBundle(bundle, passphrase)
+	if err != nil {
+		logger.Errorf("Error encoding bundle: %v", err)
+		return 1
+	}
+	if err := (Output{Path: flags.Arg(0), Mode: 0600, UID: -1, GID: -1}).Write(data); err != nil {
+		logger.Errorf("Error saving bundle: %v", err)
+		return 1
+	}
+	if len(passphrase) == 0 {
+		logger.Warnln("The bundle is not encrypted, keep it safe as it holds the private key")
+	}
+	logger.Infof("Registration of %s exported to %s", bundle.Hash, flags.Arg(0))
+
+	return 0
+}
+
+// importCommand restores a bundle made by export, so the device takes over
+// the registration of the exported one without being claimed again. It
+// returns the exit status.
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	passphraseFile := flags.String("passphrase-file", "", "File holding the passphrase the bundle is encrypted with")
+	force := flags.Bool("force", false, "Replace the registration already on the database")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: rb_register [options] import [-passphrase-file file] [-force] <bundle>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if len(*dbFile) == 0 {
+		logger.Errorln("No database given, the registration is kept on -db")
+		return 1
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		logger.Errorf("Error reading passphrase: %v", err)
+		return 1
+	}
+	files, err := bundleOutputs()
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+	bundle, err := decodeBundle(data, passphrase)
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+	if err := bundle.Validate(); err != nil {
+		logger.Errorf("Invalid bundle: %v", err)
+		return 1
+	}
+
+	db, err := openStateStore(false)
+	if err != nil {
+		logger.Errorln(err)
+		return 1
+	}
+	defer db.Close()
+
+	identities, err := db.ListIdentities()
+	if err != nil {
+		logger.Errorf("Error loading UUIDs: %v", err)
+		return 1
+	}
+	states, err := db.ListStates()
+	if err != nil {
+		logger.Errorf("Error loading states: %v", err)
+		return 1
+	}
+	if (len(identities) > 0 || len(states) > 0) && !*force {
+		logger.Errorln("The database already holds a registration, use -force to replace it")
+		return 1
+	}
+
+	// The finish script has not run on the new device yet
+	for _, state := range bundle.States {
+		if state.Status == stateProvisioned {
+			state.Status = stateClaimed
+			state.ProvisionedAt = time.Time{}
+		}
+	}
+
+	// Keep the files replaced so they can be restored with rollback, or if the
+	// import fails
+	backups := newBackups()
+	var generation string
+	if backups != nil {
+		var replaced []Output
+		for name := range bundle.Files {
+			replaced = append(replaced, files[name])
+		}
+		if generation, err = backups.Save(replaced...); err != nil {
+			logger.Errorf("Error saving backup: %v", err)
+			return 1
+		}
+		logger.Infof("Replaced files saved on backup %s", generation)
+	}
+
+	// The registration is replaced at once, before any file is written
+	if err := db.ReplaceRegistrations(bundle.Identities, bundle.States); err != nil {
+		logger.Errorf("Error saving registration: %v", err)
+		return 1
+	}
+
+	for name, data := range bundle.Files {
+		file := files[name]
+		if len(file.Path) == 0 {
+			logger.Warnf("The %s file is not restored, no path is configured for it", name)
+			continue
+		}
+		if err := file.Write(data); err != nil {
+			logger.Errorf("Error restoring %s: %v", file.Path, err)
+			if err := db.ReplaceRegistrations(identities, states); err != nil {
+				logger.Errorf("Error restoring the previous registration: %v", err)
+			}
+			if backups != nil {
+				if err := backups.Restore(generation); err != nil {
+					logger.Errorf("Error restoring backup %s: %v", generation, err)
+				}
+			}
+			return 1
+		}
+		logger.Debugf("Restored %s", file.Path)
+	}
+
+	for _, event := range bundle.Events {
+		if err := db.AddEvent(event); err != nil {
+			logger.Warnf("Error restoring history: %v", err)
+			break
+		}
+	}
+
+	logger.Infof("Registration of %s imported from %s", bundle.Hash, flags.Arg(0))
+	if bundle.Hash != *hash {
+		logger.Warnf("Run rb_register with -hash %s to resume the imported registration", bundle.Hash)
+	}
+
+	return 0
+}
+
+// bundleOutputs returns the files that make up the identity of the device,
+// configured on the command line, by their name on the bundles
+func bundleOutputs() (map[string]Output, error) {
+	certOutput, err := newOutput(*certFile, certMode, *certOwner)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid certificate owner: %s", err)
+	}
+	nodenameOutput, err := newOutput(*nodenameFile, nodenameMode, *nodenameOwner)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nodename owner: %s", err)
+	}
+	enrollKey := *enrollKeyFile
+	if len(enrollKey) == 0 {
+		enrollKey = *certFile + ".key"
+	}
+
+	return map[string]Output{
+		bundleCertFile:      certOutput,
+		bundleKeyOutFile:    {Path: *keyOut, Mode: certOutput.Mode, UID: certOutput.UID, GID: certOutput.GID},
+		bundleCertOutFile:   {Path: *certOut, Mode: 0644, UID: certOutput.UID, GID: certOutput.GID},
+		bundleCAOutFile:     {Path: *caOut, Mode: 0644, UID: certOutput.UID, GID: certOutput.GID},
+		bundleNodenameFile:  nodenameOutput,
+		bundleEnrollKeyFile: {Path: enrollKey, Mode: 0600, UID: certOutput.UID, GID: certOutput.GID},
+		bundleHashFile:      {Path: *hashFile, Mode: 0644, UID: -1, GID: -1},
+	}, nil
+}
+
+// readPassphrase reads the passphrase kept on a file, without the trailing
+// newline. There is no passphrase if no file is given.
+func readPassphrase(path string) (string, error) {
+	if len(path) == 0 {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if len(passphrase) == 0 {
+		return "", errors.New(path + " is empty")
+	}
+
+	return passphrase, nil
+}
+
+// deregisterDevice sends the deregister order to the manager that issued the
+// UUID, or to the managers if unknown, presenting the client certificate if
+// there is one. A device unknown to the manager is
+// considered deregistered.
+func deregisterDevice(ctx context.Context, state *State, config APIClientConfig) error {
+	if len(*discover) > 0 {
+		discovered, _ := discoveryProcess(ctx, *discover, true, nil)
+		config.URLs = append(discovered, config.URLs...)
+	}
+	// Legacy devices keep only the private key on -cert, so the bootstrap
+	// certificate, if any, is presented instead
+	if creds, err := readCredentials(*certFile); err == nil && creds.Key != nil {
+		config.ClientCertFile = *certFile
+		config.ClientKeyFile = *certFile
+	}
+
+	apiClient := NewAPIClient(config)
+	if apiClient == nil {
+		return errors.New("Invalid API client configuration")
+	}
+	if len(state.Manager) > 0 {
+		apiClient.SetEndpoint(state.Manager)
+	}
+
+	err := apiClient.DeregisterContext(ctx, state.UUID)
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		logger.Warnln("Device unknown to the manager")
+		return nil
+	}
+
+	return err
+}
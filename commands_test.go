@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the local state is removed without contacting the manager
+func Test_DeregisterCommand_LocalOnly(t *testing.T) {
+	dir := t.TempDir()
+	defer func(keep int, db string) { *backupKeep, *dbFile = keep, db }(*backupKeep, *dbFile)
+	*backupKeep = 0
+	*dbFile = ""
+
+	cert := Output{Path: filepath.Join(dir, "client.pem"), Mode: 0600, UID: -1, GID: -1}
+	nodename := Output{Path: filepath.Join(dir, "nodename"), Mode: 0644, UID: -1, GID: -1}
+	missing := Output{Path: filepath.Join(dir, "rb-uuid"), Mode: 0644, UID: -1, GID: -1}
+	cert.Write([]byte("cert"))
+	nodename.Write([]byte("node"))
+
+	status := deregisterCommand(context.Background(), []string{"-local-only"}, validConfig,
+		[]Output{cert, nodename, missing})
+
+	assert.Equal(t, 0, status, "Wrong exit status")
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files, "Files not removed")
+}
+
+// Test nothing is removed if the manager can't be notified
+func Test_DeregisterCommand_No_UUID(t *testing.T) {
+	dir := t.TempDir()
+	defer func(db string) { *dbFile = db }(*dbFile)
+	*dbFile = ""
+
+	cert := Output{Path: filepath.Join(dir, "client.pem"), Mode: 0600, UID: -1, GID: -1}
+	cert.Write([]byte("cert"))
+
+	status := deregisterCommand(context.Background(), nil, validConfig, []Output{cert})
+
+	assert.Equal(t, 1, status, "Wrong exit status")
+	_, err := os.Stat(cert.Path)
+	assert.NoError(t, err, "File removed")
+}
+
+// Test devices keeping only the private key on -cert are deregistered
+func Test_DeregisterCommand_Key_Only(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status": "deregistered"}`)
+	}))
+	defer server.Close()
+
+	testDeviceFiles(t)
+	defer func(h string) { *hash = h }(*hash)
+	*hash = "hash"
+	db, err := openStateStore(false)
+	if !assert.NoError(t, err, "Unexpected error") {
+		return
+	}
+	db.StoreUUID("", "hash", "00000000-0000-0000-0000-000000000000")
+	db.StoreUUID("https://other", "hash", "11111111-1111-1111-1111-111111111111")
+	db.StoreUUID("https://other", "neighbour", "22222222-2222-2222-2222-222222222222")
+	db.Close()
+
+	key, _ := generateKey(ecdsaKey, 256)
+	data, _ := encodeKey(key)
+	cert := Output{Path: *certFile, Mode: 0600, UID: -1, GID: -1}
+	cert.Write(data)
+
+	config := validConfig
+	config.URL = server.URL
+	status := deregisterCommand(context.Background(), nil, config, []Output{cert})
+
+	assert.Equal(t, 0, status, "Wrong exit status")
+	_, err = os.Stat(cert.Path)
+	assert.True(t, os.IsNotExist(err), "File not removed")
+
+	// The UUIDs issued by every manager are removed, only for this hash
+	db, err = openStateStore(false)
+	if !assert.NoError(t, err, "Unexpected error") {
+		return
+	}
+	defer db.Close()
+	identities, _ := db.ListIdentities()
+	assert.Equal(t, []Identity{
+		{Manager: "https://other", Hash: "neighbour", UUID: "22222222-2222-2222-2222-222222222222"},
+	}, identities, "Wrong identities")
+}
+
+// Test the history is printed as a table
+func Test_PrintEvents(t *testing.T) {
+	var buf bytes.Buffer
+	events := []Event{{
+		Time:       time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC),
+		Order:      "verify",
+		Manager:    "https://manager/api/v1/sensors",
+		HTTPStatus: 503,
+		Latency:    1500 * time.Microsecond,
+		Error:      "Got status code: 503 Service Unavailable",
+	}}
+
+	assert.NoError(t, printEvents(&buf, events), "Unexpected error")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2, "Wrong number of lines") {
+		assert.True(t, strings.HasPrefix(lines[0], "TIME"), "Header not found")
+		assert.Equal(t, []string{"2016-10-17T12:00:00Z", "verify", "https://manager/api/v1/sensors", "503", "2ms",
+			"Got", "status", "code:", "503", "Service", "Unavailable"}, strings.Fields(lines[1]), "Wrong row")
+	}
+}
+
+// Helper function to point the files of the device to a temporary directory
+func testDeviceFiles(t *testing.T) {
+	dir := t.TempDir()
+	cert, nodename, hashPath, db, driver, keep := *certFile, *nodenameFile, *hashFile, *dbFile, *dbDriver, *backupKeep
+	t.Cleanup(func() {
+		*certFile, *nodenameFile, *hashFile, *dbFile, *dbDriver, *backupKeep = cert, nodename, hashPath, db, driver, keep
+	})
+
+	*certFile = filepath.Join(dir, "client.pem")
+	*nodenameFile = filepath.Join(dir, "nodename")
+	*hashFile = filepath.Join(dir, "rb-uuid")
+	*dbFile = filepath.Join(dir, "rb-register.json")
+	*dbDriver = jsonDriver
+	*backupKeep = 0
+}
+
+// Test the registration is moved to another device with export and import
+func Test_ExportImportCommand(t *testing.T) {
+	bundle := testExportBundle(t)
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	ioutil.WriteFile(passphraseFile, []byte("secret\n"), 0600)
+
+	// Exported device, the finish script already ran on it
+	bundle.States[0].Transition(stateProvisioned, time.Date(2016, 10, 17, 12, 5, 0, 0, time.UTC))
+	testDeviceFiles(t)
+	db, err := openStateStore(false)
+	if !assert.NoError(t, err, "Unexpected error") {
+		return
+	}
+	db.StoreUUID(bundle.Identities[0].Manager, "hash", bundle.Identities[0].UUID)
+	db.StoreState(bundle.States[0])
+	db.Close()
+	ioutil.WriteFile(*certFile, bundle.Files[bundleCertFile], 0600)
+	ioutil.WriteFile(*nodenameFile, bundle.Files[bundleNodenameFile], 0644)
+
+	defer func(h string) { *hash = h }(*hash)
+	*hash = "hash"
+	assert.Equal(t, 0, exportCommand([]string{"-passphrase-file", passphraseFile, path}), "Wrong exit status")
+
+	// Replacement
+	testDeviceFiles(t)
+	assert.Equal(t, 1, importCommand([]string{path}), "Imported without passphrase")
+	assert.Equal(t, 0, importCommand([]string{"-passphrase-file", passphraseFile, path}), "Wrong exit status")
+
+	cert, _ := ioutil.ReadFile(*certFile)
+	assert.Equal(t, bundle.Files[bundleCertFile], cert, "Certificate not restored")
+	nodename, _ := ioutil.ReadFile(*nodenameFile)
+	assert.Equal(t, "node", string(nodename), "Nodename not restored")
+	db, err = openStateStore(false)
+	if !assert.NoError(t, err, "Unexpected error") {
+		return
+	}
+	defer db.Close()
+	state, err := loadState(db, []string{"https://manager"})
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, stateClaimed, state.Status, "Wrong status")
+	assert.True(t, state.ProvisionedAt.IsZero(), "Wrong provision time")
+	assert.Equal(t, bundle.States[0].UUID, state.UUID, "Wrong UUID")
+	assert.True(t, credentialsInstalled(state), "Credentials not installed")
+
+	// The registration is not replaced by accident
+	assert.Equal(t, 1, importCommand([]string{"-passphrase-file", passphraseFile, path}), "Registration replaced")
+}
+
+// Test the registration on the database is kept when a file can't be written
+func Test_ImportCommand_Write_Error(t *testing.T) {
+	bundle := testExportBundle(t)
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	data, _ := encodeBundle(bundle, "")
+	ioutil.WriteFile(path, data, 0600)
+
+	testDeviceFiles(t)
+	db, err := openStateStore(false)
+	if !assert.NoError(t, err, "Unexpected error") {
+		return
+	}
+	db.StoreUUID("https://manager", "old", "00000000-0000-0000-0000-000000000000")
+	db.Close()
+
+	// The nodename can't be written under a regular file
+	blocker := filepath.Join(t.TempDir(), "file")
+	ioutil.WriteFile(blocker, nil, 0600)
+	*nodenameFile = filepath.Join(blocker, "nodename")
+	assert.Equal(t, 1, importCommand([]string{"-force", path}), "Wrong exit status")
+
+	db, err = openStateStore(false)
+	if !assert.NoError(t, err, "Unexpected error") {
+		return
+	}
+	defer db.Close()
+	identities, _ := db.ListIdentities()
+	assert.Equal(t, []Identity{
+		{Manager: "https://manager", Hash: "old", UUID: "00000000-0000-0000-0000-000000000000"},
+	}, identities, "Registration not restored")
+	states, _ := db.ListStates()
+	assert.Empty(t, states, "Registration not restored")
+}
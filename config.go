@@ -19,6 +19,7 @@ package main
 import (
 	"database/sql"
 	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -27,17 +28,94 @@ import (
 type APIClientConfig struct {
 	Insecure   bool          // If true, skip SSL verification
 	URL        string        // API url
+	URLs       []string      // Alternative API urls, in priority order
 	Hash       string        // Required hash to perform the registration
 	Cpus       int           // Number of CPU of the computer
 	Memory     uint64        // Amount of memory of the computer
 	DeviceType int           // Type of the requesting device
 	Logger     *logrus.Entry // Logger to use
 	HTTPClient *http.Client  // HTTP Client to wrap
+	Timeout    time.Duration // Maximum duration of a single request
+	Clock      Clock         // Source of time
+
+	ClientCertFile string // Certificate presented to the API over mTLS
+	ClientKeyFile  string // Private key of the client certificate
+
+	CAFile     string   // CA bundle used to verify the API
+	PinnedKeys []string // Base64 SHA-256 hashes of the allowed API public keys
+
+	SigningKeyFile string // Public key of the manager signing the responses
+
+	History EventRecorder // Records every request sent, may be nil
+
+	Proxy   string // Proxy URL (http, https or socks5), may carry credentials
+	NoProxy string // Comma separated hosts to reach without the proxy
+
+	EndpointCooldown time.Duration // Time a failed API url is skipped
+	MaxRetryAfter    time.Duration // Longest Retry-After honored from the API
+
+	CSR string // PEM certificate request sent on verify orders
 }
 
 // DatabaseConfig stores the database configuration
 type DatabaseConfig struct {
-	sqldb  *sql.DB
-	dbFile string
-	Logger *logrus.Logger // Logger to use
+	sqldb   *sql.DB
+	dbFile  string
+	History HistoryRetention // Events kept
+	Logger  *logrus.Logger   // Logger to use
+}
+
+// StoreConfig stores the configuration of the state stores written in Go
+type StoreConfig struct {
+	Path     string           // File holding the state
+	History  HistoryRetention // Events kept
+	ReadOnly bool             // Only read the state, sharing the file with other readers
+	Logger   *logrus.Logger   // Logger to use
+}
+
+// BackoffConfig stores the exponential backoff configuration
+type BackoffConfig struct {
+	Initial    time.Duration  // Delay before the first retry
+	Max        time.Duration  // Upper limit for the delay
+	Multiplier float64        // Growth factor applied on every attempt
+	Jitter     float64        // Fraction of the delay to randomize (0 to 1)
+	Rand       func() float64 // Random source in [0, 1)
+}
+
+// ClaimScheduleConfig stores the configuration of the claim wait schedule
+type ClaimScheduleConfig struct {
+	Fast    time.Duration  // Delay while the fast window is open
+	FastFor time.Duration  // Duration of the fast window
+	Slow    time.Duration  // Delay once the fast window is closed
+	Jitter  float64        // Fraction of the delay to randomize (0 to 1)
+	Clock   Clock          // Source of time
+	Rand    func() float64 // Random source in [0, 1)
+}
+
+// RenewerConfig stores the certificate renewal configuration
+type RenewerConfig struct {
+	Client   APIClientConfig    // API configuration, the client certificate is the bundle
+	UUID     string             // UUID issued on the registration
+	Endpoint string             // API url that issued the UUID
+	Outputs  CredentialOutputs  // Files to replace, the bundle is watched
+	Nodename Output             // Nodename to replace, skipped if Path is empty
+	Before   time.Duration      // Time before the expiration to renew
+	Enroll   bool               // Generate the new key locally and send a CSR
+	KeyType  string             // Type of the generated key
+	KeyBits  int                // Size of the generated key
+	Hook     string             // Script to call after a renewal
+	HookLog  string             // Log to save the result of the hook
+	Policy   RetryPolicy        // Time between failed renewals
+	Backups  *Backups           // Backups of the replaced files, nil to disable
+	Renewed  func(*Credentials) // Called with the credentials installed, may be nil
+	Clock    Clock              // Source of time
+	Logger   *logrus.Entry      // Logger to use
+}
+
+// BackupConfig stores the configuration of the credential backups
+type BackupConfig struct {
+	Dir    string        // Directory holding a subdirectory per generation
+	Keep   int           // Number of generations kept
+	Clock  Clock         // Source of time
+	Logger *logrus.Entry // Logger to use
 }
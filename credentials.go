@@ -0,0 +1,297 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimum size of the RSA keys accepted
+const minRSABits = 2048
+
+// errNoCertificate is returned when reading credentials that only hold a key,
+// like the ones issued to legacy devices
+var errNoCertificate = errors.New("No certificate found")
+
+// Credentials is the key and certificates received when the device is claimed
+type Credentials struct {
+	Key   crypto.Signer       // Private key, nil if not received
+	Certs []*x509.Certificate // Certificates, leaf first
+	CA    []*x509.Certificate // CA certificates of the manager, if received
+}
+
+// parseCredentials strictly decodes a PEM bundle. Every block must be a
+// private key or a certificate, there can be only one key and there can't be
+// anything but whitespace outside the blocks.
+func parseCredentials(data []byte) (*Credentials, error) {
+	creds := &Credentials{}
+
+	rest := bytes.TrimSpace(data)
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("Malformed PEM data")
+		}
+		rest = bytes.TrimSpace(rest)
+
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid certificate: %v", err)
+			}
+			creds.Certs = append(creds.Certs, cert)
+
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY":
+			if creds.Key != nil {
+				return nil, errors.New("More than one private key found")
+			}
+			key, err := parseKeyBlock(block)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid private key: %v", err)
+			}
+			creds.Key = key
+
+		default:
+			return nil, errors.New("Unexpected PEM block: " + block.Type)
+		}
+	}
+
+	if creds.Key == nil && len(creds.Certs) == 0 {
+		return nil, errors.New("No private key or certificate found")
+	}
+
+	return creds, nil
+}
+
+// Validate checks the key is strong enough and, if there is a certificate,
+// that it belongs to the key, it is valid at the given time and it has been
+// issued to the node. If the CA has been received the certificate must be
+// issued by it.
+func (c *Credentials) Validate(nodename string, now time.Time) error {
+	if c.Key != nil {
+		if err := checkKeyStrength(c.Key); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Certs) == 0 {
+		return nil
+	}
+	leaf := c.Certs[0]
+
+	if c.Key != nil {
+		pub, ok := c.Key.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(leaf.PublicKey) {
+			return errors.New("Certificate doesn't match the private key")
+		}
+	}
+
+	if now.Before(leaf.NotBefore) {
+		return errors.New("Certificate is not valid until " + leaf.NotBefore.String())
+	}
+	if now.After(leaf.NotAfter) {
+		return errors.New("Certificate expired on " + leaf.NotAfter.String())
+	}
+
+	if len(nodename) > 0 && leaf.Subject.CommonName != nodename {
+		return fmt.Errorf("Certificate issued to %q instead of %q", leaf.Subject.CommonName, nodename)
+	}
+
+	if len(c.CA) > 0 {
+		opts := x509.VerifyOptions{
+			Roots:         x509.NewCertPool(),
+			Intermediates: x509.NewCertPool(),
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		for _, ca := range c.CA {
+			opts.Roots.AddCert(ca)
+		}
+		for _, cert := range c.Certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(opts); err != nil {
+			return fmt.Errorf("Certificate not issued by the CA: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// readCredentials reads a PEM bundle holding at least one certificate
+func readCredentials(path string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := parseCredentials(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(creds.Certs) == 0 {
+		return nil, fmt.Errorf("%w on %s", errNoCertificate, path)
+	}
+
+	return creds, nil
+}
+
+// Fingerprint returns the hex SHA-256 of the certificate, or an empty string
+// if there is none
+func (c *Credentials) Fingerprint() string {
+	if len(c.Certs) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(c.Certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyPEM returns the private key encoded as PEM
+func (c *Credentials) KeyPEM() ([]byte, error) {
+	if c.Key == nil {
+		return nil, errors.New("No private key found")
+	}
+
+	return encodeKey(c.Key)
+}
+
+// CertsPEM returns the certificate followed by the intermediates as PEM
+func (c *Credentials) CertsPEM() []byte {
+	return encodeCerts(c.Certs)
+}
+
+// CAPEM returns the CA certificates as PEM
+func (c *Credentials) CAPEM() []byte {
+	return encodeCerts(c.CA)
+}
+
+// Bundle returns the private key followed by the certificates as PEM, the
+// format of the client.pem file used by chef
+func (c *Credentials) Bundle() ([]byte, error) {
+	if c.Key == nil {
+		return c.CertsPEM(), nil
+	}
+
+	key, err := c.KeyPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(key, c.CertsPEM()...), nil
+}
+
+// encodeCerts encodes a list of certificates as PEM
+func encodeCerts(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	return buf.Bytes()
+}
+
+// checkKeyStrength rejects unknown key types and weak keys
+func checkKeyStrength(key crypto.Signer) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if bits := k.N.BitLen(); bits < minRSABits {
+			return errors.New("RSA key too small: " + strconv.Itoa(bits) + " bits")
+		}
+	case *ecdsa.PrivateKey:
+		if bits := k.Curve.Params().BitSize; bits < 256 {
+			return errors.New("ECDSA curve too small: " + strconv.Itoa(bits) + " bits")
+		}
+	case ed25519.PrivateKey:
+	default:
+		return fmt.Errorf("Unsupported private key: %T", key)
+	}
+
+	return nil
+}
+
+// receivedCredentials parses and validates the material sent by the API. The
+// key, the certificate and the intermediates may come in the same field or
+// apart. If enrollKey is given it is used as the key, unless the API sent its
+// own key (legacy), and the certificate may be issued to enrollName, the
+// subject of the CSR, instead of the nodename.
+func receivedCredentials(claim Claim, enrollKey crypto.Signer, enrollName string,
+	now time.Time) (creds *Credentials, legacy bool, err error) {
+	var bundle string
+	for _, payload := range []string{claim.Key, claim.Cert, claim.Chain} {
+		if len(strings.TrimSpace(payload)) == 0 {
+			continue
+		}
+		data, err := decodePayload(payload, claim.Encoding)
+		if err != nil {
+			return nil, false, err
+		}
+		bundle += data
+	}
+
+	if enrollKey != nil {
+		if bundle, legacy, err = enrollmentBundle(enrollKey, bundle); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if creds, err = parseCredentials([]byte(bundle)); err != nil {
+		return nil, legacy, err
+	}
+
+	if len(strings.TrimSpace(claim.CA)) > 0 {
+		ca, err := decodePayload(claim.CA, claim.Encoding)
+		if err != nil {
+			return nil, legacy, fmt.Errorf("Invalid CA: %v", err)
+		}
+		caCreds, err := parseCredentials([]byte(ca))
+		if err != nil {
+			return nil, legacy, fmt.Errorf("Invalid CA: %v", err)
+		}
+		if caCreds.Key != nil {
+			return nil, legacy, errors.New("Invalid CA: private key found")
+		}
+		creds.CA = caCreds.Certs
+	}
+
+	// The API may sign the CSR as submitted
+	commonName := claim.Nodename
+	if enrollKey != nil && !legacy && len(creds.Certs) > 0 && creds.Certs[0].Subject.CommonName == enrollName {
+		commonName = enrollName
+	}
+	if err := creds.Validate(commonName, now); err != nil {
+		return nil, legacy, err
+	}
+
+	return creds, legacy, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to create a PEM bundle with key and a certificate for it
+// valid between notBefore and notAfter
+func testBundle(t *testing.T, key crypto.Signer, cn string, notBefore, notAfter time.Time) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return append(keyPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+}
+
+// Test a key and a certificate issued to the node are accepted
+func Test_Credentials_Valid(t *testing.T) {
+	key, _ := generateKey(ecdsaKey, 256)
+	now := time.Now()
+	bundle := testBundle(t, key, "sensor1", now.Add(-time.Hour), now.Add(time.Hour))
+
+	creds, err := parseCredentials(bundle)
+	assert.NoError(t, err, "Unexpected error")
+	assert.NotNil(t, creds.Key, "Key not found")
+	assert.Len(t, creds.Certs, 1, "Certificate not found")
+	assert.NoError(t, creds.Validate("sensor1", now), "Unexpected error")
+}
+
+// Test a bundle with only a private key is accepted
+func Test_Credentials_Key_Only(t *testing.T) {
+	key, _ := generateKey(ecdsaKey, 256)
+	keyPEM, _ := encodeKey(key)
+
+	creds, err := parseCredentials(keyPEM)
+	assert.NoError(t, err, "Unexpected error")
+	assert.NoError(t, creds.Validate("sensor1", time.Now()), "Unexpected error")
+}
+
+// Test truncated and malformed PEM data is rejected
+func Test_Credentials_Malformed(t *testing.T) {
+	_, err := parseCredentials([]byte(certificate))
+	assert.Error(t, err, "Expected error")
+
+	_, err = parseCredentials([]byte("garbage"))
+	assert.Error(t, err, "Expected error")
+
+	_, err = parseCredentials([]byte(""))
+	assert.Error(t, err, "Expected error")
+
+	key, _ := generateKey(ecdsaKey, 256)
+	keyPEM, _ := encodeKey(key)
+	_, err = parseCredentials(append(keyPEM, "garbage"...))
+	assert.Error(t, err, "Expected error")
+
+	_, err = parseCredentials(append(keyPEM, keyPEM...))
+	assert.Error(t, err, "Expected error")
+
+	_, err = parseCredentials(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}))
+	assert.Error(t, err, "Expected error")
+
+	_, err = parseCredentials(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}))
+	assert.Error(t, err, "Expected error")
+}
+
+// Test a certificate for another key is rejected
+func Test_Credentials_Key_Mismatch(t *testing.T) {
+	key, _ := generateKey(ecdsaKey, 256)
+	other, _ := generateKey(ecdsaKey, 256)
+	now := time.Now()
+	bundle := testBundle(t, key, "sensor1", now.Add(-time.Hour), now.Add(time.Hour))
+	otherPEM, _ := encodeKey(other)
+	block, _ := pem.Decode(bundle)
+	certPEM := bundle[len(pem.EncodeToMemory(block)):]
+
+	creds, err := parseCredentials(append(otherPEM, certPEM...))
+	assert.NoError(t, err, "Unexpected error")
+	assert.Error(t, creds.Validate("sensor1", now), "Expected error")
+}
+
+// Test certificates out of their validity period are rejected
+func Test_Credentials_Expired(t *testing.T) {
+	key, _ := generateKey(ecdsaKey, 256)
+	now := time.Now()
+	bundle := testBundle(t, key, "sensor1", now.Add(-time.Hour), now.Add(time.Hour))
+
+	creds, err := parseCredentials(bundle)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Error(t, creds.Validate("sensor1", now.Add(2*time.Hour)), "Expected error")
+	assert.Error(t, creds.Validate("sensor1", now.Add(-2*time.Hour)), "Expected error")
+}
+
+// Test a certificate issued to another node is rejected
+func Test_Credentials_Wrong_Nodename(t *testing.T) {
+	key, _ := generateKey(ecdsaKey, 256)
+	now := time.Now()
+	bundle := testBundle(t, key, "sensor1", now.Add(-time.Hour), now.Add(time.Hour))
+
+	creds, err := parseCredentials(bundle)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Error(t, creds.Validate("sensor2", now), "Expected error")
+}
+
+// Test weak keys are rejected
+func Test_Credentials_Weak_Key(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, _ := encodeKey(key)
+
+	creds, err := parseCredentials(keyPEM)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Error(t, creds.Validate("", time.Now()), "Expected error")
+}
+
+// Helper function to create a certificate for key signed by parent, or self
+// signed if parent is nil
+func testCert(t *testing.T, key crypto.Signer, cn string, isCA bool, parent *x509.Certificate, parentKey crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// Helper function to create a claim with the key, the certificate, an
+// intermediate and the CA apart
+func testClaim(t *testing.T) Claim {
+	caKey, _ := generateKey(ecdsaKey, 256)
+	ca := testCert(t, caKey, "ca", true, nil, nil)
+	interKey, _ := generateKey(ecdsaKey, 256)
+	inter := testCert(t, interKey, "intermediate", true, ca, caKey)
+	key, _ := generateKey(ecdsaKey, 256)
+	leaf := testCert(t, key, "node", false, inter, interKey)
+	keyPEM, _ := encodeKey(key)
+
+	return Claim{
+		Key:      string(keyPEM),
+		Cert:     string(encodeCerts([]*x509.Certificate{leaf})),
+		Chain:    string(encodeCerts([]*x509.Certificate{inter})),
+		CA:       string(encodeCerts([]*x509.Certificate{ca})),
+		Nodename: "node",
+	}
+}
+
+// Test the key, certificate, intermediates and CA can be received apart
+func Test_ReceivedCredentials_Structured(t *testing.T) {
+	claim := testClaim(t)
+
+	creds, legacy, err := receivedCredentials(claim, nil, "", time.Now())
+
+	assert.NoError(t, err, "Unexpected error")
+	assert.False(t, legacy, "Unexpected legacy")
+	assert.Len(t, creds.Certs, 2, "Wrong certificates")
+	assert.Len(t, creds.CA, 1, "Wrong CA")
+	assert.Equal(t, claim.Cert+claim.Chain, string(creds.CertsPEM()), "Wrong certificates")
+	assert.Equal(t, claim.CA, string(creds.CAPEM()), "Wrong CA")
+	bundle, _ := creds.Bundle()
+	assert.Equal(t, claim.Key+claim.Cert+claim.Chain, string(bundle), "Wrong bundle")
+}
+
+// Test certificates not issued by the CA are rejected
+func Test_ReceivedCredentials_Wrong_CA(t *testing.T) {
+	claim := testClaim(t)
+	claim.CA = testClaim(t).CA
+
+	_, _, err := receivedCredentials(claim, nil, "", time.Now())
+	assert.Error(t, err, "Expected error")
+
+	claim = testClaim(t)
+	claim.Chain = ""
+	_, _, err = receivedCredentials(claim, nil, "", time.Now())
+	assert.Error(t, err, "Expected error")
+}
+
+// Test the escaped certificate of old managers is still accepted
+func Test_ReceivedCredentials_Escaped(t *testing.T) {
+	key, _ := generateKey(ecdsaKey, 256)
+	now := time.Now()
+	bundle := testBundle(t, key, "node", now.Add(-time.Hour), now.Add(time.Hour))
+	escaped := `"` + strings.Replace(string(bundle), "\n", "\\n", -1) + `"`
+
+	creds, _, err := receivedCredentials(Claim{Cert: escaped, Nodename: "node"}, nil, "", now)
+	assert.NoError(t, err, "Unexpected error")
+	data, _ := creds.Bundle()
+	assert.Equal(t, string(bundle), string(data), "Wrong bundle")
+}
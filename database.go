@@ -14,24 +14,132 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
+//go:build cgo
+// +build cgo
+
 package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 const (
-	sqlCreateTable   = "CREATE TABLE IF NOT EXISTS Devices (Hash varchar(255) PRIMARY KEY, Uuid varchar(255))"
-	sqlInsertEntry   = "INSERT INTO Devices (Hash, Uuid) values (?, ?)"
-	sqlSelectDevices = "SELECT * FROM Devices"
+	sqlCreateTable = "CREATE TABLE IF NOT EXISTS Devices (Hash varchar(255) PRIMARY KEY, Uuid varchar(255))"
+
+	sqlCreateIdentities = "CREATE TABLE Identities (Manager varchar(255) NOT NULL DEFAULT '', " +
+		"Hash varchar(255) NOT NULL, Uuid varchar(255), PRIMARY KEY (Manager, Hash))"
+	sqlCopyDevices        = "INSERT INTO Identities (Manager, Hash, Uuid) SELECT '', Hash, Uuid FROM Devices"
+	sqlDropDevices        = "DROP TABLE Devices"
+	sqlRenameIdentities   = "ALTER TABLE Identities RENAME TO Devices"
+	sqlCreateDevicesIndex = "CREATE INDEX DevicesHash ON Devices (Hash)"
+	sqlSelectUUID         = "SELECT Uuid FROM Devices WHERE Manager = ? AND Hash = ?"
+	sqlUpsertUUID         = "INSERT INTO Devices (Manager, Hash, Uuid) values (?, ?, ?) " +
+		"ON CONFLICT (Manager, Hash) DO UPDATE SET Uuid = excluded.Uuid"
+	sqlDeleteUUID       = "DELETE FROM Devices WHERE Manager = ? AND Hash = ?"
+	sqlSelectIdentities = "SELECT Manager, Hash, Uuid FROM Devices ORDER BY Hash, Manager"
+
+	sqlCreateStates = "CREATE TABLE IF NOT EXISTS States (Hash varchar(255) PRIMARY KEY, Uuid varchar(255), " +
+		"Status varchar(32), Nodename varchar(255), Manager varchar(255), Fingerprint varchar(64), " +
+		"RegisteredAt integer, ClaimedAt integer, ProvisionedAt integer, UpdatedAt integer, " +
+		"Attempts integer, LastError text)"
+	sqlUpsertState = "INSERT INTO States (Hash, Uuid, Status, Nodename, Manager, Fingerprint, " +
+		"RegisteredAt, ClaimedAt, ProvisionedAt, UpdatedAt, Attempts, LastError) " +
+		"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (Hash) DO UPDATE SET " +
+		"Uuid = excluded.Uuid, Status = excluded.Status, Nodename = excluded.Nodename, " +
+		"Manager = excluded.Manager, Fingerprint = excluded.Fingerprint, " +
+		"RegisteredAt = excluded.RegisteredAt, ClaimedAt = excluded.ClaimedAt, " +
+		"ProvisionedAt = excluded.ProvisionedAt, UpdatedAt = excluded.UpdatedAt, " +
+		"Attempts = excluded.Attempts, LastError = excluded.LastError"
+	sqlSelectState = "SELECT Hash, Uuid, Status, Nodename, Manager, Fingerprint, RegisteredAt, ClaimedAt, " +
+		"ProvisionedAt, UpdatedAt, Attempts, LastError FROM States WHERE Hash = ?"
+	sqlSelectStates = "SELECT Hash, Uuid, Status, Nodename, Manager, Fingerprint, RegisteredAt, ClaimedAt, " +
+		"ProvisionedAt, UpdatedAt, Attempts, LastError FROM States ORDER BY Hash"
+	sqlDeleteState = "DELETE FROM States WHERE Hash = ?"
+
+	sqlDeleteIdentities = "DELETE FROM Devices"
+	sqlDeleteStates     = "DELETE FROM States"
+
+	sqlCreateSchemaVersion = "CREATE TABLE IF NOT EXISTS schema_version (Version integer PRIMARY KEY, " +
+		"Description text, AppliedAt integer)"
+	sqlSelectSchemaVersion = "SELECT COALESCE(MAX(Version), 0) FROM schema_version"
+	sqlInsertSchemaVersion = "INSERT INTO schema_version (Version, Description, AppliedAt) values (?, ?, ?)"
+	sqlCountTables         = "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	sqlCountAllTables      = "SELECT count(*) FROM sqlite_master WHERE type = 'table'"
+	sqlBackupDatabase      = "VACUUM INTO ?"
+	sqlIntegrityCheck      = "PRAGMA integrity_check"
+
+	sqlCreateEvents = "CREATE TABLE Events (Id integer PRIMARY KEY AUTOINCREMENT, Time integer, " +
+		"Hash varchar(255), Request varchar(32), Manager varchar(255), HTTPStatus integer, " +
+		"Status varchar(32), Latency integer, Error text)"
+	sqlCreateEventsIndex = "CREATE INDEX EventsTime ON Events (Time)"
+	sqlInsertEvent       = "INSERT INTO Events (Time, Hash, Request, Manager, HTTPStatus, Status, Latency, Error) " +
+		"values (?, ?, ?, ?, ?, ?, ?, ?)"
+	sqlDeleteOldEvents   = "DELETE FROM Events WHERE Time < ?"
+	sqlDeleteExtraEvents = "DELETE FROM Events WHERE Id <= (SELECT Id FROM Events ORDER BY Id DESC LIMIT 1 OFFSET ?)"
+	sqlSelectLastEvents  = "SELECT Time, Hash, Request, Manager, HTTPStatus, Status, Latency, Error FROM " +
+		"(SELECT * FROM Events ORDER BY Id DESC LIMIT ?) ORDER BY Id"
 )
 
+// migration changes the schema of the database to the next version
+type migration struct {
+	description string   // What the migration does
+	statements  []string // Statements run on a single transaction
+}
+
+// Migrations of the schema in order, the version of a database is the number
+// of them applied. Released migrations must not be changed, any change of the
+// schema is a new migration appended to the list. The first ones are
+// idempotent since they were applied before versioning.
+var migrations = []migration{
+	{"Create Devices table", []string{sqlCreateTable}},
+	{"Create States table", []string{sqlCreateStates}},
+	{"Create Events table", []string{sqlCreateEvents, sqlCreateEventsIndex}},
+	{"Key devices by manager and hash", []string{sqlCreateIdentities, sqlCopyDevices, sqlDropDevices,
+		sqlRenameIdentities, sqlCreateDevicesIndex}},
+}
+
+// Order of the event recorded when a corrupted database is recovered, and
+// the status telling how
+const (
+	recoveryOrder     = "recover"
+	recoveryRestored  = "restored"
+	recoveryRecreated = "recreated"
+)
+
+// Suffix of the copy of the database saved every time it passes the
+// integrity check
+const snapshotSuffix = ".good"
+
+// Statements prepared when the database is opened
+var preparedStatements = []string{
+	sqlSelectUUID, sqlUpsertUUID, sqlDeleteUUID, sqlSelectIdentities,
+	sqlSelectState, sqlSelectStates, sqlUpsertState, sqlDeleteState,
+}
+
+// The sqlite driver needs cgo, so it is only available on cgo builds
+func init() {
+	storeDrivers[sqliteDriver] = func(config StoreConfig) StateStore {
+		db := NewDatabase(DatabaseConfig{dbFile: config.Path, History: config.History, Logger: config.Logger})
+		if db != nil {
+			return db
+		}
+		return nil
+	}
+}
+
 // Database handles the connection with a SQL Database
 type Database struct {
 	config DatabaseConfig
+	stmts  map[string]*sql.Stmt // Prepared statements by query
 }
 
 // NewDatabase creates a new instance of a database
@@ -49,58 +157,302 @@ func NewDatabase(config DatabaseConfig) *Database {
 		return nil
 	}
 
-	var err error
-	db.config.sqldb, err = sql.Open("sqlite3", db.config.dbFile)
-	if err != nil {
-		logger.Fatal(err)
+	err := db.open()
+	if err == nil {
+		err = checkIntegrity(db.config.sqldb)
 	}
 
-	// Ping db to check if db is available
-	if err := db.config.sqldb.Ping(); err != nil {
+	// A corrupted database is replaced so the device can register again
+	var recovery *Event
+	if corrupted(err) {
+		logger.Errorf("Database %s is corrupted: %v", db.config.dbFile, err)
+		var event Event
+		if event, err = db.recoverCorrupted(err); err == nil {
+			recovery = &event
+		}
+	}
+	if err != nil {
 		logger.Error(err)
 		return nil
 	}
 
-	// Init connection with db
-	if _, err := db.config.sqldb.Begin(); err != nil {
+	// Bring the schema up to date
+	if err := db.migrate(); err != nil {
 		logger.Error(err)
 		return nil
 	}
 
-	// Create table if no exists
-	if _, err := db.config.sqldb.Exec(sqlCreateTable); err != nil {
-		logger.Error(err)
-		return nil
+	db.stmts = make(map[string]*sql.Stmt)
+	for _, query := range preparedStatements {
+		stmt, err := db.config.sqldb.Prepare(query)
+		if err != nil {
+			logger.Error(err)
+			db.Close()
+			return nil
+		}
+		db.stmts[query] = stmt
+	}
+
+	if recovery != nil {
+		if err := db.AddEvent(*recovery); err != nil {
+			logger.Warnf("Error recording database recovery: %v", err)
+		}
+	}
+	if err := db.snapshot(); err != nil {
+		logger.Warnf("Error saving database snapshot: %v", err)
 	}
 
 	return db
 }
 
-// LoadUUID loads from the database the UUID used along with a previous HASH
-func (db *Database) LoadUUID(hash string) (uuid string, err error) {
-	logger := db.config.Logger
+// open connects to the database file, creating it if it doesn't exist
+func (db *Database) open() error {
+	var err error
+	db.config.sqldb, err = sql.Open("sqlite3", db.config.dbFile)
+	if err != nil {
+		db.config.Logger.Fatal(err)
+	}
+
+	// Ping db to check if db is available
+	return db.config.sqldb.Ping()
+}
+
+// integrityError lists the problems found by the integrity check
+type integrityError []string
+
+func (e integrityError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// corrupted checks if an error means the database file is damaged, as opposed
+// to being locked or unreadable
+func corrupted(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrNotADB || sqliteErr.Code == sqlite3.ErrCorrupt
+	}
+
+	var problems integrityError
+	return errors.As(err, &problems)
+}
 
-	// Get all the rows and load data
-	rows, err := db.config.sqldb.Query(sqlSelectDevices)
+// checkIntegrity runs the sqlite integrity check, returning the problems found
+func checkIntegrity(sqldb *sql.DB) error {
+	rows, err := sqldb.Query(sqlIntegrityCheck)
 	if err != nil {
-		return
+		return err
 	}
+	defer rows.Close()
 
+	var problems integrityError
 	for rows.Next() {
-		var devHash sql.NullString
-		var devUUID sql.NullString
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// recoverCorrupted moves the corrupted database aside, along with its
+// journal, and replaces it with the last snapshot that passed the integrity
+// check. If there is no valid snapshot the database is recreated empty. It
+// returns the event to record once the database is ready.
+func (db *Database) recoverCorrupted(problem error) (Event, error) {
+	logger := db.config.Logger
+	db.config.sqldb.Close()
 
-		if err = rows.Scan(&devHash, &devUUID); err != nil {
-			return
+	now := time.Now()
+	quarantine := fmt.Sprintf("%s.corrupt-%d", db.config.dbFile, now.Unix())
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		err := os.Rename(db.config.dbFile+suffix, quarantine+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return Event{}, fmt.Errorf("Error moving corrupted database: %v", err)
 		}
+	}
+	logger.Warnf("Corrupted database moved to %s", quarantine)
+
+	event := Event{Time: now, Order: recoveryOrder, Status: recoveryRecreated, Error: problem.Error()}
+	snapshot := db.config.dbFile + snapshotSuffix
+	if err := restoreSnapshot(snapshot, db.config.dbFile); err != nil {
+		logger.Warnf("Database recreated empty, snapshot not restored: %v", err)
+	} else {
+		logger.Warnf("Database restored from %s", snapshot)
+		event.Status = recoveryRestored
+	}
 
-		// If hash is in database load the associated UUID
-		if devHash.String == hash {
-			uuid = devUUID.String
-			break
+	return event, db.open()
+}
+
+// restoreSnapshot copies a snapshot over the database if it passes the
+// integrity check
+func restoreSnapshot(snapshot, path string) error {
+	data, err := ioutil.ReadFile(snapshot)
+	if err != nil {
+		return err
+	}
+
+	sqldb, err := sql.Open("sqlite3", snapshot)
+	if err != nil {
+		return err
+	}
+	err = checkIntegrity(sqldb)
+	sqldb.Close()
+	if err != nil {
+		return fmt.Errorf("Snapshot %s is corrupted: %v", snapshot, err)
+	}
+
+	return Output{Path: path, Mode: 0600, UID: -1, GID: -1}.Write(data)
+}
+
+// snapshot saves a copy of the database to restore if it gets corrupted. The
+// copy is written apart and then renamed, so the previous one is kept if it
+// fails.
+func (db *Database) snapshot() error {
+	path := db.config.dbFile + snapshotSuffix
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := db.config.sqldb.Exec(sqlBackupDatabase, tmp); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// refreshSnapshot replaces the snapshot after the registration changes, so a
+// recovery doesn't bring back an older one. The snapshot is kept if the
+// database doesn't pass the integrity check.
+func (db *Database) refreshSnapshot() {
+	logger := db.config.Logger
+
+	err := checkIntegrity(db.config.sqldb)
+	if err == nil {
+		err = db.snapshot()
+	}
+	if err != nil {
+		logger.Warnf("Error saving database snapshot: %v", err)
+	}
+}
+
+// SchemaVersion returns the number of migrations applied to the database
+func (db *Database) SchemaVersion() (int, error) {
+	var tables int
+	if err := db.config.sqldb.QueryRow(sqlCountTables, "schema_version").Scan(&tables); err != nil {
+		return 0, err
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+
+	var version int
+	err := db.config.sqldb.QueryRow(sqlSelectSchemaVersion).Scan(&version)
+
+	return version, err
+}
+
+// migrate applies the pending migrations, each one on its own transaction.
+// The database is backed up before changing it. A database with a newer
+// schema than this version knows is left untouched and an error is returned.
+func (db *Database) migrate() error {
+	logger := db.config.Logger
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("Database schema version %d is newer than the supported %d", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	if err := db.backup(version); err != nil {
+		return fmt.Errorf("Error backing up database before migrating: %v", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		m := migrations[version]
+		if err := db.applyMigration(version+1, m); err != nil {
+			return fmt.Errorf("Database migration to version %d failed: %v", version+1, err)
 		}
+		logger.Infof("Database migrated to version %d: %s", version+1, m.description)
+	}
+
+	return nil
+}
+
+// backup copies the database to a file named after its schema version. New
+// databases, without any table, are not backed up.
+func (db *Database) backup(version int) error {
+	var tables int
+	if err := db.config.sqldb.QueryRow(sqlCountAllTables).Scan(&tables); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return nil
+	}
+
+	path := fmt.Sprintf("%s.v%d.bak", db.config.dbFile, version)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := db.config.sqldb.Exec(sqlBackupDatabase, path); err != nil {
+		return err
+	}
+	db.config.Logger.Infof("Database backed up on %s", path)
+
+	return nil
+}
+
+// applyMigration runs a migration and records the new version on the same
+// transaction, so it is either fully applied or not at all
+func (db *Database) applyMigration(version int, m migration) error {
+	tx, err := db.config.sqldb.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
+	statements := append([]string{sqlCreateSchemaVersion}, m.statements...)
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(sqlInsertSchemaVersion, version, m.description, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LoadUUID loads from the database the UUID issued by a manager for a HASH
+func (db *Database) LoadUUID(manager, hash string) (uuid string, err error) {
+	logger := db.config.Logger
+
+	var devUUID sql.NullString
+	err = db.stmts[sqlSelectUUID].QueryRow(manager, hash).Scan(&devUUID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	uuid = devUUID.String
 	if len(uuid) > 0 {
 		logger.Debugf("Loaded UUID from DB: %s", uuid)
 	}
@@ -108,21 +460,267 @@ func (db *Database) LoadUUID(hash string) (uuid string, err error) {
 	return
 }
 
-// StoreUUID save the UUD to a database
-func (db *Database) StoreUUID(hash, uuid string) error {
+// StoreUUID save the UUID issued by a manager for a HASH, replacing the
+// previous one
+func (db *Database) StoreUUID(manager, hash, uuid string) error {
 	logger := db.config.Logger
 
-	// Insert data into DB
-	if _, err := db.config.sqldb.Exec(sqlInsertEntry, hash, uuid); err != nil {
+	if _, err := db.stmts[sqlUpsertUUID].Exec(manager, hash, uuid); err != nil {
 		return err
 	}
 
 	logger.Infof("Stored UUID on DB: %s", uuid)
+	db.refreshSnapshot()
+
+	return nil
+}
+
+// DeleteUUID removes the UUID issued by a manager for a HASH
+func (db *Database) DeleteUUID(manager, hash string) error {
+	logger := db.config.Logger
+
+	if _, err := db.stmts[sqlDeleteUUID].Exec(manager, hash); err != nil {
+		return err
+	}
+
+	logger.Infof("Removed UUID of %s from DB", hash)
+	db.refreshSnapshot()
+
+	return nil
+}
+
+// ListIdentities returns every UUID on the database, sorted by HASH and manager
+func (db *Database) ListIdentities() ([]Identity, error) {
+	rows, err := db.stmts[sqlSelectIdentities].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var identity Identity
+		var uuid sql.NullString
+		if err := rows.Scan(&identity.Manager, &identity.Hash, &uuid); err != nil {
+			return nil, err
+		}
+		identity.UUID = uuid.String
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// LoadState loads from the database the registration state of a HASH. It
+// returns nil if there is none.
+func (db *Database) LoadState(hash string) (*State, error) {
+	state, err := scanState(db.stmts[sqlSelectState].QueryRow(hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return state, err
+}
+
+// ListStates loads from the database the registration state of every HASH
+func (db *Database) ListStates() ([]*State, error) {
+	rows, err := db.stmts[sqlSelectStates].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []*State
+	for rows.Next() {
+		state, err := scanState(rows)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+
+	return states, rows.Err()
+}
+
+// scanState decodes a row of the States table
+func scanState(row interface{ Scan(...interface{}) error }) (*State, error) {
+	state := &State{}
+	var registeredAt, claimedAt, provisionedAt, updatedAt int64
+
+	err := row.Scan(&state.Hash, &state.UUID, &state.Status, &state.Nodename, &state.Manager,
+		&state.Fingerprint, &registeredAt, &claimedAt, &provisionedAt, &updatedAt,
+		&state.Attempts, &state.LastError)
+	if err != nil {
+		return nil, err
+	}
+
+	state.RegisteredAt = unixTime(registeredAt)
+	state.ClaimedAt = unixTime(claimedAt)
+	state.ProvisionedAt = unixTime(provisionedAt)
+	state.UpdatedAt = unixTime(updatedAt)
+
+	return state, nil
+}
+
+// StoreState saves the registration state of a HASH, replacing the previous one.
+// The snapshot is only refreshed on a new status or UUID, not on every attempt.
+func (db *Database) StoreState(state *State) error {
+	logger := db.config.Logger
+
+	previous, err := db.LoadState(state.Hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.stmts[sqlUpsertState].Exec(state.Hash, state.UUID, state.Status,
+		state.Nodename, state.Manager, state.Fingerprint, timeUnix(state.RegisteredAt),
+		timeUnix(state.ClaimedAt), timeUnix(state.ProvisionedAt), timeUnix(state.UpdatedAt),
+		state.Attempts, state.LastError)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("Stored %s state on DB", state.Status)
+	if previous == nil || previous.Status != state.Status || previous.UUID != state.UUID {
+		db.refreshSnapshot()
+	}
+
+	return nil
+}
+
+// ReplaceRegistrations replaces every UUID and state on a single transaction
+func (db *Database) ReplaceRegistrations(identities []Identity, states []*State) error {
+	logger := db.config.Logger
+
+	tx, err := db.config.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(sqlDeleteIdentities); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqlDeleteStates); err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		if _, err := tx.Exec(sqlUpsertUUID, identity.Manager, identity.Hash, identity.UUID); err != nil {
+			return err
+		}
+	}
+	for _, state := range states {
+		_, err := tx.Exec(sqlUpsertState, state.Hash, state.UUID, state.Status,
+			state.Nodename, state.Manager, state.Fingerprint, timeUnix(state.RegisteredAt),
+			timeUnix(state.ClaimedAt), timeUnix(state.ProvisionedAt), timeUnix(state.UpdatedAt),
+			state.Attempts, state.LastError)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.Infof("Replaced registrations on DB: %d UUIDs, %d states", len(identities), len(states))
+	db.refreshSnapshot()
+
+	return nil
+}
+
+// AddEvent appends an event, removing the ones beyond the retention
+func (db *Database) AddEvent(event Event) error {
+	tx, err := db.config.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(sqlInsertEvent, event.Time.UnixNano(), event.Hash, event.Order, event.Manager,
+		event.HTTPStatus, event.Status, int64(event.Latency), event.Error)
+	if err != nil {
+		return err
+	}
+
+	retention := db.config.History
+	if retention.Age > 0 {
+		if _, err := tx.Exec(sqlDeleteOldEvents, event.Time.Add(-retention.Age).UnixNano()); err != nil {
+			return err
+		}
+	}
+	if retention.Keep > 0 {
+		if _, err := tx.Exec(sqlDeleteExtraEvents, retention.Keep); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// LoadEvents returns the newest events oldest first, all if limit is 0
+func (db *Database) LoadEvents(limit int) ([]Event, error) {
+	if limit <= 0 {
+		limit = -1 // No limit on sqlite
+	}
+
+	rows, err := db.config.sqldb.Query(sqlSelectLastEvents, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		var at, latency int64
+		err := rows.Scan(&at, &event.Hash, &event.Order, &event.Manager, &event.HTTPStatus,
+			&event.Status, &latency, &event.Error)
+		if err != nil {
+			return nil, err
+		}
+		event.Time = time.Unix(0, at)
+		event.Latency = time.Duration(latency)
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// unixTime converts the seconds stored on the database to a time, zero meaning
+// it never happened
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, 0)
+}
+
+// timeUnix converts a time to the seconds stored on the database
+func timeUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// DeleteState removes the registration state of a HASH
+func (db *Database) DeleteState(hash string) error {
+	if _, err := db.stmts[sqlDeleteState].Exec(hash); err != nil {
+		return err
+	}
+
+	db.refreshSnapshot()
 
 	return nil
 }
 
 // Close closes the connection with the database
 func (db *Database) Close() {
+	for _, stmt := range db.stmts {
+		stmt.Close()
+	}
 	db.config.sqldb.Close()
 }
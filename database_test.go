@@ -0,0 +1,241 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to create a database on a temporary directory
+func testDatabase(t *testing.T) *Database {
+	db := NewDatabase(DatabaseConfig{dbFile: filepath.Join(t.TempDir(), "rb-register.db")})
+	if db == nil {
+		t.Fatal("Error opening database")
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+// Test the registration state is persisted with every transition
+func Test_Database_State(t *testing.T) {
+	db := testDatabase(t)
+	now := time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	state, err := db.LoadState("hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Nil(t, state, "State should not exist")
+
+	state = newState("hash")
+	state.Attempt(errors.New("Got status code: 503"), now)
+	assert.NoError(t, db.StoreState(state), "Unexpected error")
+
+	state.UUID = "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"
+	state.Manager = "https://manager"
+	state.Transition(stateRegistered, now.Add(time.Minute))
+	state.Attempt(nil, now.Add(2*time.Minute))
+	assert.NoError(t, db.StoreState(state), "Unexpected error")
+
+	loaded, err := db.LoadState("hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, stateRegistered, loaded.Status, "Wrong status")
+	assert.Equal(t, state.UUID, loaded.UUID, "Wrong UUID")
+	assert.Equal(t, state.Manager, loaded.Manager, "Wrong manager")
+	assert.True(t, now.Add(time.Minute).Equal(loaded.RegisteredAt), "Wrong registration time")
+	assert.True(t, loaded.ClaimedAt.IsZero(), "Wrong claim time")
+	assert.Equal(t, 1, loaded.Attempts, "Wrong attempts")
+	assert.Empty(t, loaded.LastError, "Error of the previous status kept")
+
+	assert.NoError(t, db.DeleteState("hash"), "Unexpected error")
+	loaded, err = db.LoadState("hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Nil(t, loaded, "State not removed")
+}
+
+// Test databases holding only the UUID are resumed as registered
+func Test_LoadState_Legacy(t *testing.T) {
+	db := testDatabase(t)
+	assert.NoError(t, db.StoreUUID("", *hash, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"), "Unexpected error")
+
+	state, err := loadState(db, []string{"https://manager"})
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, stateRegistered, state.Status, "Wrong status")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", state.UUID, "Wrong UUID")
+	assert.Empty(t, state.Manager, "Wrong manager")
+
+	// The UUID of a configured manager is preferred
+	assert.NoError(t, db.StoreUUID("https://other", *hash, "00000000-0000-0000-0000-000000000000"), "Unexpected error")
+	assert.NoError(t, db.StoreUUID("https://manager", *hash, "11111111-1111-1111-1111-111111111111"), "Unexpected error")
+	state, err = loadState(db, []string{"https://manager"})
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "11111111-1111-1111-1111-111111111111", state.UUID, "Wrong UUID")
+	assert.Equal(t, "https://manager", state.Manager, "Wrong manager")
+
+	state, err = loadState(nil, nil)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, stateRegistering, state.Status, "Wrong status")
+}
+
+// Helper function to create a database file with raw statements
+func testRawDatabase(t *testing.T, statements ...string) string {
+	path := filepath.Join(t.TempDir(), "rb-register.db")
+	sqldb, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err, "Unexpected error")
+	defer sqldb.Close()
+
+	for _, statement := range statements {
+		_, err := sqldb.Exec(statement)
+		assert.NoError(t, err, "Unexpected error")
+	}
+
+	return path
+}
+
+// Test new databases get the latest schema without a backup
+func Test_Database_Migrate_New(t *testing.T) {
+	db := testDatabase(t)
+
+	version, err := db.SchemaVersion()
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, len(migrations), version, "Wrong schema version")
+
+	_, err = os.Stat(db.config.dbFile + ".v0.bak")
+	assert.True(t, os.IsNotExist(err), "New database backed up")
+}
+
+// Test databases created before versioning are backed up and migrated keeping
+// their data
+func Test_Database_Migrate_Legacy(t *testing.T) {
+	path := testRawDatabase(t, sqlCreateTable,
+		"INSERT INTO Devices (Hash, Uuid) values ('hash', '7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b')")
+
+	db := NewDatabase(DatabaseConfig{dbFile: path})
+	if !assert.NotNil(t, db, "Database should not be nil") {
+		return
+	}
+	defer db.Close()
+
+	version, _ := db.SchemaVersion()
+	assert.Equal(t, len(migrations), version, "Wrong schema version")
+	uuid, err := db.LoadUUID("", "hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "UUID lost")
+	_, err = db.LoadState("hash")
+	assert.NoError(t, err, "States table not created")
+
+	backup, _ := sql.Open("sqlite3", path+".v0.bak")
+	defer backup.Close()
+	err = backup.QueryRow("SELECT Uuid FROM Devices WHERE Hash = 'hash'").Scan(&uuid)
+	assert.NoError(t, err, "Backup not found")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "UUID not backed up")
+}
+
+// Test databases written by a newer version are not opened nor modified
+func Test_Database_Migrate_Newer(t *testing.T) {
+	path := testRawDatabase(t, sqlCreateSchemaVersion,
+		"INSERT INTO schema_version (Version, Description, AppliedAt) values (99, 'Future', 0)")
+	before, _ := ioutil.ReadFile(path)
+
+	assert.Nil(t, NewDatabase(DatabaseConfig{dbFile: path}), "Database should be nil")
+
+	after, _ := ioutil.ReadFile(path)
+	assert.Equal(t, before, after, "Database modified")
+}
+
+// Helper function to find the files a corrupted database was moved to
+func testQuarantined(t *testing.T, path string) []string {
+	matches, err := filepath.Glob(path + ".corrupt-*")
+	assert.NoError(t, err, "Unexpected error")
+
+	return matches
+}
+
+// Test a corrupted database without a snapshot is quarantined and recreated
+func Test_Database_Recover_Recreated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rb-register.db")
+	ioutil.WriteFile(path, []byte("This is not a sqlite database, but it is long enough to look like one."), 0600)
+
+	db := NewDatabase(DatabaseConfig{dbFile: path})
+	if !assert.NotNil(t, db, "Database should not be nil") {
+		return
+	}
+	defer db.Close()
+
+	assert.Len(t, testQuarantined(t, path), 1, "Corrupted database not quarantined")
+	events, err := db.LoadEvents(0)
+	assert.NoError(t, err, "Unexpected error")
+	if assert.Len(t, events, 1, "Recovery not recorded") {
+		assert.Equal(t, recoveryOrder, events[0].Order, "Wrong order")
+		assert.Equal(t, recoveryRecreated, events[0].Status, "Wrong status")
+		assert.NotEmpty(t, events[0].Error, "Problem not recorded")
+	}
+}
+
+// Test the registration made since the database was opened survives a
+// corruption
+func Test_Database_Recover_Registration(t *testing.T) {
+	db := testDatabase(t)
+	path := db.config.dbFile
+	assert.NoError(t, db.StoreUUID("", "hash", "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"), "Unexpected error")
+	state := newState("hash")
+	state.UUID = "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"
+	state.Transition(stateRegistered, time.Now())
+	assert.NoError(t, db.StoreState(state), "Unexpected error")
+	db.Close()
+	ioutil.WriteFile(path, []byte("This is not a sqlite database, but it is long enough to look like one."), 0600)
+
+	db = NewDatabase(DatabaseConfig{dbFile: path})
+	if !assert.NotNil(t, db, "Database should not be nil") {
+		return
+	}
+	defer db.Close()
+
+	uuid, err := db.LoadUUID("", "hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "UUID not restored")
+	loaded, err := db.LoadState("hash")
+	assert.NoError(t, err, "Unexpected error")
+	if assert.NotNil(t, loaded, "State not restored") {
+		assert.Equal(t, stateRegistered, loaded.Status, "Wrong status")
+	}
+}
+
+// Test a corrupted database is restored from the last snapshot
+func Test_Database_Recover_Restored(t *testing.T) {
+	db := testDatabase(t)
+	path := db.config.dbFile
+	assert.NoError(t, db.StoreUUID("", "hash", "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"), "Unexpected error")
+	db.Close()
+
+	// The snapshot is saved every time the database is opened
+	db = NewDatabase(DatabaseConfig{dbFile: path})
+	if !assert.NotNil(t, db, "Database should not be nil") {
+		return
+	}
+	db.Close()
+	ioutil.WriteFile(path, []byte("This is not a sqlite database, but it is long enough to look like one."), 0600)
+
+	db = NewDatabase(DatabaseConfig{dbFile: path})
+	if !assert.NotNil(t, db, "Database should not be nil") {
+		return
+	}
+	defer db.Close()
+
+	assert.Len(t, testQuarantined(t, path), 1, "Corrupted database not quarantined")
+	uuid, err := db.LoadUUID("", "hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "UUID not restored")
+	events, _ := db.LoadEvents(0)
+	if assert.NotEmpty(t, events, "Recovery not recorded") {
+		assert.Equal(t, recoveryRestored, events[len(events)-1].Status, "Wrong status")
+	}
+}
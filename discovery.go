@@ -0,0 +1,157 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	discoveryService = "rb-register"
+	discoveryProto   = "tcp"
+	discoveryScheme  = "https"
+	discoveryPath    = "/api/v1/sensors"
+)
+
+// Resolver is the part of net.Resolver used to discover the API
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// discoverEndpoints finds the registration URLs of a domain. The managers are
+// taken from the _rb-register._tcp SRV records, ordered by priority and
+// weight. A TXT record with the same name can override the API path and the
+// scheme using "path=" and "scheme=" entries. DNS answers aren't
+// authenticated, so plain http is only accepted if allowHTTP is set.
+func discoverEndpoints(ctx context.Context, resolver Resolver, domain string, allowHTTP bool,
+	random func(int) int) ([]string, error) {
+	name, records, err := resolver.LookupSRV(ctx, discoveryService, discoveryProto, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, path := discoveryScheme, discoveryPath
+	if txts, err := resolver.LookupTXT(ctx, name); err == nil {
+		for _, txt := range txts {
+			switch {
+			case strings.HasPrefix(txt, "path="):
+				path = strings.TrimPrefix(txt, "path=")
+			case strings.HasPrefix(txt, "scheme="):
+				scheme = strings.TrimPrefix(txt, "scheme=")
+			}
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if scheme != "https" && !(scheme == "http" && allowHTTP) {
+		return nil, errors.New("Scheme not allowed on discovery: " + scheme)
+	}
+
+	var urls []string
+	for _, srv := range orderSRV(records, random) {
+		target := strings.TrimSuffix(srv.Target, ".")
+		if len(target) == 0 {
+			continue // The service is explicitly not available
+		}
+
+		host := target
+		if !(scheme == "https" && srv.Port == 443) && !(scheme == "http" && srv.Port == 80) {
+			host = net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+		}
+		urls = append(urls, scheme+"://"+host+path)
+	}
+
+	if len(urls) == 0 {
+		return nil, errors.New("No managers found for " + domain)
+	}
+
+	return urls, nil
+}
+
+// orderSRV sorts the records by priority and, within the same priority, by a
+// weighted random selection as described in RFC 2782. random returns a number
+// in [0, n).
+func orderSRV(records []*net.SRV, random func(int) int) []*net.SRV {
+	if random == nil {
+		random = rand.Intn
+	}
+
+	sorted := make([]*net.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	var ordered []*net.SRV
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+		ordered = append(ordered, shuffleByWeight(sorted[i:j], random)...)
+		i = j
+	}
+
+	return ordered
+}
+
+// shuffleByWeight orders records of the same priority picking each one with a
+// probability proportional to its weight
+func shuffleByWeight(records []*net.SRV, random func(int) int) []*net.SRV {
+	pending := make([]*net.SRV, len(records))
+	copy(pending, records)
+
+	// Records without weight go first so they have a small chance of being
+	// selected
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Weight == 0 && pending[j].Weight != 0
+	})
+
+	var ordered []*net.SRV
+	for len(pending) > 0 {
+		total := 0
+		for _, r := range pending {
+			total += int(r.Weight)
+		}
+
+		chosen := 0
+		if total > 0 {
+			n := random(total + 1)
+			sum := 0
+			for i, r := range pending {
+				sum += int(r.Weight)
+				if sum >= n {
+					chosen = i
+					break
+				}
+			}
+		}
+
+		ordered = append(ordered, pending[chosen])
+		pending = append(pending[:chosen], pending[chosen+1:]...)
+	}
+
+	return ordered
+}
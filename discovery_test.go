@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsStub is a minimal DNS server answering SRV and TXT questions from memory
+type dnsStub struct {
+	srv map[string][]dnsmessage.SRVResource
+	txt map[string][]string
+}
+
+// Helper function to start a DNS stub and get a resolver that uses it
+func startDNSStub(t *testing.T, stub *dnsStub) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if res, err := stub.answer(buf[:n]); err == nil {
+				conn.WriteTo(res, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *dnsStub) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	name := question.Name.String()
+	header.Response = true
+	header.Authoritative = true
+	if len(s.srv[name]) == 0 && len(s.txt[name]) == 0 {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch question.Type {
+	case dnsmessage.TypeSRV:
+		for _, srv := range s.srv[name] {
+			b.SRVResource(rh, srv)
+		}
+	case dnsmessage.TypeTXT:
+		for _, txt := range s.txt[name] {
+			b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{txt}})
+		}
+	}
+
+	return b.Finish()
+}
+
+// Test the managers are discovered from the SRV and TXT records
+func Test_DiscoverEndpoints(t *testing.T) {
+	resolver := startDNSStub(t, &dnsStub{
+		srv: map[string][]dnsmessage.SRVResource{
+			"_rb-register._tcp.example.com.": {
+				{Priority: 20, Weight: 0, Port: 443, Target: dnsmessage.MustNewName("backup.example.com.")},
+				{Priority: 10, Weight: 100, Port: 8443, Target: dnsmessage.MustNewName("primary.example.com.")},
+			},
+		},
+		txt: map[string][]string{
+			"_rb-register._tcp.example.com.": {"path=/api/v2/sensors"},
+		},
+	})
+
+	urls, err := discoverEndpoints(context.Background(), resolver, "example.com", false, nil)
+
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, []string{
+		"https://primary.example.com:8443/api/v2/sensors",
+		"https://backup.example.com/api/v2/sensors",
+	}, urls, "Wrong managers")
+}
+
+// Test the default path is used without TXT record
+func Test_DiscoverEndpoints_Default_Path(t *testing.T) {
+	resolver := startDNSStub(t, &dnsStub{
+		srv: map[string][]dnsmessage.SRVResource{
+			"_rb-register._tcp.example.com.": {
+				{Priority: 10, Weight: 0, Port: 443, Target: dnsmessage.MustNewName("manager.example.com.")},
+			},
+		},
+	})
+
+	urls, err := discoverEndpoints(context.Background(), resolver, "example.com", false, nil)
+
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, []string{"https://manager.example.com/api/v1/sensors"}, urls, "Wrong managers")
+}
+
+// Test a TXT record can't downgrade the scheme to http unless allowed
+func Test_DiscoverEndpoints_HTTP(t *testing.T) {
+	resolver := startDNSStub(t, &dnsStub{
+		srv: map[string][]dnsmessage.SRVResource{
+			"_rb-register._tcp.example.com.": {
+				{Priority: 10, Weight: 0, Port: 80, Target: dnsmessage.MustNewName("manager.example.com.")},
+			},
+		},
+		txt: map[string][]string{
+			"_rb-register._tcp.example.com.": {"scheme=http"},
+		},
+	})
+
+	_, err := discoverEndpoints(context.Background(), resolver, "example.com", false, nil)
+	assert.Error(t, err, "Expected error")
+
+	urls, err := discoverEndpoints(context.Background(), resolver, "example.com", true, nil)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, []string{"http://manager.example.com/api/v1/sensors"}, urls, "Wrong managers")
+}
+
+// Test discovery fails for a domain without records
+func Test_DiscoverEndpoints_Not_Found(t *testing.T) {
+	resolver := startDNSStub(t, &dnsStub{})
+
+	_, err := discoverEndpoints(context.Background(), resolver, "example.com", false, nil)
+
+	assert.Error(t, err, "Expected error")
+}
+
+// Test records of the same priority are ordered by weight
+func Test_OrderSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c.", Priority: 20, Weight: 10},
+		{Target: "a.", Priority: 10, Weight: 10},
+		{Target: "b.", Priority: 10, Weight: 90},
+	}
+
+	// Always pick the highest number: the last record reached on the sum
+	ordered := orderSRV(records, func(n int) int { return n - 1 })
+	assert.Equal(t, "b.", ordered[0].Target, "Wrong order")
+	assert.Equal(t, "a.", ordered[1].Target, "Wrong order")
+	assert.Equal(t, "c.", ordered[2].Target, "Wrong order")
+
+	// Always pick the lowest number: the first record
+	ordered = orderSRV(records, func(n int) int { return 0 })
+	assert.Equal(t, "a.", ordered[0].Target, "Wrong order")
+	assert.Equal(t, "b.", ordered[1].Target, "Wrong order")
+	assert.Equal(t, "c.", ordered[2].Target, "Wrong order")
+}
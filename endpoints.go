@@ -0,0 +1,126 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Default time an endpoint is skipped after a failure
+const defaultEndpointCooldown = time.Minute
+
+// endpoint is a manager URL along with its health status
+type endpoint struct {
+	url       string
+	failures  int       // Consecutive failed requests
+	downUntil time.Time // The endpoint is skipped until this time
+}
+
+// newEndpoints builds the list of endpoints in priority order, discarding
+// duplicated URLs
+func newEndpoints(urls ...string) []*endpoint {
+	var endpoints []*endpoint
+	seen := make(map[string]bool)
+
+	for _, u := range urls {
+		if len(u) == 0 || seen[u] {
+			continue
+		}
+		seen[u] = true
+		endpoints = append(endpoints, &endpoint{url: u})
+	}
+
+	return endpoints
+}
+
+// healthy checks if the endpoint can be used at the given time
+func (e *endpoint) healthy(now time.Time) bool {
+	return !now.Before(e.downUntil)
+}
+
+// send posts a request to the managers. If the client has been pinned to an
+// endpoint only that one is used. Otherwise the endpoints are tried in
+// priority order, skipping the ones that failed recently, until one of them
+// answers or fails with a permanent error. It returns the endpoint that gave
+// the last answer.
+func (c *APIClient) send(ctx context.Context, req, res interface{}) (*endpoint, error) {
+	if c.pinned != nil {
+		return c.pinned, c.sendTo(ctx, c.pinned, req, res)
+	}
+
+	now := c.config.Clock.Now()
+	candidates := make([]*endpoint, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		if e.healthy(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		// Every endpoint is down, so try all of them again
+		candidates = c.endpoints
+	}
+
+	var err error
+	for _, e := range candidates {
+		if err = c.sendTo(ctx, e, req, res); !isTemporary(err) || ctx.Err() != nil {
+			return e, err
+		}
+		c.config.Logger.Warnf("Manager %s failed: %v", e.url, err)
+	}
+
+	return candidates[len(candidates)-1], err
+}
+
+// sendTo posts a request to an endpoint and updates its health
+func (c *APIClient) sendTo(ctx context.Context, e *endpoint, req, res interface{}) error {
+	err := c.post(ctx, e.url, req, res)
+	if isTemporary(err) && ctx.Err() == nil {
+		e.failures++
+		e.downUntil = c.config.Clock.Now().Add(c.config.EndpointCooldown)
+		return err
+	}
+
+	e.failures = 0
+	e.downUntil = time.Time{}
+
+	return err
+}
+
+// Endpoint returns the URL of the manager the client is pinned to, or an empty
+// string if it isn't pinned yet
+func (c *APIClient) Endpoint() string {
+	if c.pinned == nil {
+		return ""
+	}
+
+	return c.pinned.url
+}
+
+// SetEndpoint pins the client to a manager URL, e.g. the one that issued a
+// previously persisted UUID. The URL is added to the endpoints if unknown.
+func (c *APIClient) SetEndpoint(url string) {
+	for _, e := range c.endpoints {
+		if e.url == url {
+			c.pinned = e
+			return
+		}
+	}
+
+	c.pinned = &endpoint{url: url}
+	c.endpoints = append(c.endpoints, c.pinned)
+}
@@ -0,0 +1,177 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	rsaKey   = "rsa"
+	ecdsaKey = "ecdsa"
+)
+
+// generateKey creates a new private key. RSA keys take the size in bits and
+// ECDSA keys the size of the curve (256, 384 or 521).
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case rsaKey:
+		if bits < 2048 {
+			return nil, errors.New("RSA keys must have at least 2048 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+
+	case ecdsaKey:
+		var curve elliptic.Curve
+		switch bits {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("Unsupported ECDSA curve size: " + strconv.Itoa(bits))
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+
+	return nil, errors.New("Unsupported key type: " + keyType)
+}
+
+// encodeKey encodes a private key as PEM. RSA keys use PKCS#1, which is the
+// format expected by chef, and unusual keys PKCS#8.
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}), nil
+
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// decodeKey parses a PEM encoded private key
+func decodeKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found")
+	}
+
+	return parseKeyBlock(block)
+}
+
+// parseKeyBlock parses the private key of a PEM block
+func parseKeyBlock(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+
+	return nil, errors.New("Unsupported private key: " + block.Type)
+}
+
+// loadOrGenerateKey loads the enrollment key stored on out. If there isn't
+// any a new one is generated and stored, so the same key is used if the
+// application is restarted while waiting for the claim.
+func loadOrGenerateKey(out Output, keyType string, bits int) (crypto.Signer, error) {
+	if data, err := ioutil.ReadFile(out.Path); err == nil {
+		return decodeKey(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := generateKey(keyType, bits)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.Write(data); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// createCSR creates a PEM encoded PKCS#10 certificate request for key
+func createCSR(key crypto.Signer, commonName string) (string, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// enrollmentBundle joins the locally generated key with the certificate issued
+// by the manager. Old managers ignore the CSR and send their own private key,
+// in that case the material received is used as is.
+func enrollmentBundle(key crypto.Signer, cert string) (bundle string, legacy bool, err error) {
+	if strings.Contains(cert, "PRIVATE KEY-----") {
+		return cert, true, nil
+	}
+
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(keyPEM) + cert, false, nil
+}
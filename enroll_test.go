@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the CSR is signed by the generated key
+func Test_CreateCSR(t *testing.T) {
+	key, err := generateKey(ecdsaKey, 256)
+	assert.NoError(t, err, "Unexpected error")
+
+	csr, err := createCSR(key, "abcdefghijklmnopqrstuvwxyz")
+	assert.NoError(t, err, "Unexpected error")
+
+	block, _ := pem.Decode([]byte(csr))
+	assert.Equal(t, "CERTIFICATE REQUEST", block.Type, "Wrong PEM type")
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	assert.NoError(t, err, "Unexpected error")
+	assert.NoError(t, req.CheckSignature(), "Wrong signature")
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", req.Subject.CommonName, "Wrong common name")
+}
+
+// Test invalid key parameters
+func Test_GenerateKey_Invalid(t *testing.T) {
+	_, err := generateKey(rsaKey, 1024)
+	assert.Error(t, err, "Expected error")
+	_, err = generateKey(ecdsaKey, 128)
+	assert.Error(t, err, "Expected error")
+	_, err = generateKey("dsa", 2048)
+	assert.Error(t, err, "Expected error")
+}
+
+// Test the same key is used after a restart
+func Test_LoadOrGenerateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enroll.key")
+
+	key, err := loadOrGenerateKey(Output{Path: path, Mode: 0600, UID: -1, GID: -1}, rsaKey, 2048)
+	assert.NoError(t, err, "Unexpected error")
+	_, ok := key.(*rsa.PrivateKey)
+	assert.True(t, ok, "Expected RSA key")
+
+	loaded, err := loadOrGenerateKey(Output{Path: path, Mode: 0600, UID: -1, GID: -1}, ecdsaKey, 256)
+	assert.NoError(t, err, "Unexpected error")
+	assert.True(t, key.(*rsa.PrivateKey).Equal(loaded), "Key should be loaded")
+}
+
+// Test the local key is joined with the certificate, unless the manager sent
+// its own key
+func Test_EnrollmentBundle(t *testing.T) {
+	key, _ := generateKey(ecdsaKey, 256)
+	cert := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+	bundle, legacy, err := enrollmentBundle(key, cert)
+	assert.NoError(t, err, "Unexpected error")
+	assert.False(t, legacy, "Should not be legacy")
+	bundleKey, err := decodeKey([]byte(bundle))
+	assert.NoError(t, err, "Unexpected error")
+	assert.True(t, key.(*ecdsa.PrivateKey).Equal(bundleKey), "Wrong key on bundle")
+	assert.Contains(t, bundle, cert, "Certificate not on bundle")
+
+	bundle, legacy, err = enrollmentBundle(key, certificate)
+	assert.NoError(t, err, "Unexpected error")
+	assert.True(t, legacy, "Should be legacy")
+	assert.Equal(t, certificate, bundle, "Bundle should not change")
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Maximum size of an error body that will be decoded
+const maxErrorBodySize = 64 * 1024
+
+var (
+	// ErrAlreadyRegistered is returned when a register request is attempted on
+	// a device that has already been registered
+	ErrAlreadyRegistered = errors.New("This device is already registered")
+
+	// ErrAlreadyClaimed is returned when a verify request is attempted on a
+	// device that has already been claimed
+	ErrAlreadyClaimed = errors.New("This device is already claimed")
+)
+
+// UnknownStatusError is returned when the API answers with a status that is
+// not part of the protocol
+type UnknownStatusError struct {
+	Status string // Status received from the API
+}
+
+func (e *UnknownStatusError) Error() string {
+	return "Unknown status: " + e.Status
+}
+
+// HTTPStatusError is returned when the API answers with an HTTP error code
+type HTTPStatusError struct {
+	StatusCode int                    // HTTP status code of the response
+	Status     string                 // HTTP status line of the response
+	Body       map[string]interface{} // JSON error body, nil if not decodable
+}
+
+// newHTTPStatusError builds an HTTPStatusError from a response, decoding its
+// body if it is a JSON object
+func newHTTPStatusError(res *http.Response) *HTTPStatusError {
+	e := &HTTPStatusError{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+	if err == nil && len(body) > 0 {
+		if err := json.Unmarshal(body, &e.Body); err != nil {
+			e.Body = nil
+		}
+	}
+
+	return e
+}
+
+// Message returns the error message sent by the API, if any
+func (e *HTTPStatusError) Message() string {
+	for _, key := range []string{"message", "error"} {
+		if msg, ok := e.Body[key].(string); ok && len(msg) > 0 {
+			return msg
+		}
+	}
+
+	return ""
+}
+
+func (e *HTTPStatusError) Error() string {
+	if msg := e.Message(); len(msg) > 0 {
+		return "Got status code: " + e.Status + ": " + msg
+	}
+
+	return "Got status code: " + e.Status
+}
+
+// RetryableError is returned when the API asks the client to come back later
+// because it is rate limiting requests or it is under maintenance.
+type RetryableError struct {
+	*HTTPStatusError
+
+	RetryAfter time.Duration // Time requested by the API, zero if not given
+}
+
+func (e *RetryableError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s, retry after %v", e.HTTPStatusError.Error(), e.RetryAfter)
+	}
+
+	return e.HTTPStatusError.Error()
+}
+
+// Unwrap returns the underlying HTTPStatusError
+func (e *RetryableError) Unwrap() error {
+	return e.HTTPStatusError
+}
+
+// isTemporary checks if err is a failure that may go away by repeating the
+// request later: server side errors, timeouts and network errors. Any other
+// error means the request will never succeed.
+func isTemporary(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var retryErr *RetryableError
+	if errors.As(err, &retryErr) {
+		return true
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	// Every transport failure is reported as an url.Error, look at the cause
+	// so a rejected certificate is not mistaken for a network error
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// SignatureError is returned when a response is not signed by the manager key
+type SignatureError struct {
+	Reason string // Why the signature was rejected
+}
+
+func (e *SignatureError) Error() string {
+	return "Invalid response signature: " + e.Reason
+}
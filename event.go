@@ -0,0 +1,72 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+)
+
+// Event is a request sent to the API along with its outcome
+type Event struct {
+	Time       time.Time     `json:"time"`        // Time the request was sent
+	Hash       string        `json:"hash"`        // Hash of the device
+	Order      string        `json:"order"`       // Order of the request
+	Manager    string        `json:"manager"`     // URL of the manager
+	HTTPStatus int           `json:"http_status"` // HTTP status code, zero if there was no answer
+	Status     string        `json:"status"`      // Status decoded from the answer
+	Latency    time.Duration `json:"latency"`     // Time waiting for the answer, in nanoseconds on JSON
+	Error      string        `json:"error"`       // Error of the request, if failed
+}
+
+// EventRecorder keeps the events of the requests sent to the API
+type EventRecorder interface {
+	// AddEvent appends an event, removing the ones beyond the retention
+	AddEvent(event Event) error
+}
+
+// Default retention of the events
+const (
+	defaultHistoryKeep = 1000
+	defaultHistoryAge  = 30 * 24 * time.Hour
+)
+
+// HistoryRetention limits the events kept by a store
+type HistoryRetention struct {
+	Keep int           // Number of events kept, 0 for no limit
+	Age  time.Duration // Maximum age of the events kept, 0 for no limit
+}
+
+// expired checks if an event must be removed, given its position from the
+// oldest one, the number of events and the time of the newest one
+func (r HistoryRetention) expired(position, total int, at, now time.Time) bool {
+	if r.Keep > 0 && total-position > r.Keep {
+		return true
+	}
+
+	return r.Age > 0 && at.Before(now.Add(-r.Age))
+}
+
+// prune returns the events to keep from a list sorted oldest first, given the
+// time of the newest one
+func (r HistoryRetention) prune(events []Event, now time.Time) []Event {
+	i := 0
+	for i < len(events) && r.expired(i, len(events), events[i].Time, now) {
+		i++
+	}
+
+	return events[i:]
+}
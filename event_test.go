@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the events are removed by number and by age
+func Test_HistoryRetention_Prune(t *testing.T) {
+	now := time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Time: now.Add(-3 * time.Hour)},
+		{Time: now.Add(-2 * time.Hour)},
+		{Time: now.Add(-time.Hour)},
+		{Time: now},
+	}
+
+	assert.Len(t, HistoryRetention{}.prune(events, now), 4, "Events removed without limits")
+	assert.Equal(t, events[2:], HistoryRetention{Keep: 2}.prune(events, now), "Wrong events kept")
+	assert.Equal(t, events[1:], HistoryRetention{Age: 2 * time.Hour}.prune(events, now), "Wrong events kept")
+	assert.Equal(t, events[3:], HistoryRetention{Keep: 3, Age: 30 * time.Minute}.prune(events, now), "Wrong events kept")
+}
@@ -17,11 +17,16 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -34,40 +39,113 @@ var goVersion = runtime.Version()
 
 var (
 	debug         *bool       // Debug flag
-	apiURL        *string     // API url
+	apiURLs       stringList  // API urls in priority order
+	discover      *string     // Domain used to find the API on DNS
+	discoverHTTP  *bool       // Accept managers discovered over plain http
 	hash          *string     // Required hash to perform the registration
 	deviceAlias   *string     // Given alias of the device
-	sleepTime     *int        // Time between requests
+	sleepTime     *int        // Maximum time between requests
+	backoffInit   *int        // Initial time between requests
+	backoffMult   *float64    // Growth factor of the time between requests
+	backoffJitter *float64    // Randomization of the time between requests
+	claimFast     *int        // Time between requests while waiting a claim
+	claimFastFor  *int        // Duration of the fast claim wait
+	timeout       *int        // Maximum duration of a single request
 	insecure      *bool       // If true, skip SSL verification
+	bootstrapCert *string     // Identity certificate presented to the API
+	bootstrapKey  *string     // Private key of the identity certificate
+	caFile        *string     // CA bundle used to verify the API
+	pinnedKeys    stringList  // Pinned public keys of the API
+	signingKey    *string     // Public key of the manager signing the responses
+	proxy         *string     // Proxy used to reach the API
+	noProxy       *string     // Hosts reached without the proxy
 	certFile      *string     // Path to store de certificate
+	keyOut        *string     // Path to store the private key alone
+	certOut       *string     // Path to store the certificate and intermediates
+	caOut         *string     // Path to store the CA of the manager
+	certMode      fileMode    // Permissions of the certificate
+	certOwner     *string     // Owner of the certificate
+	enroll        *bool       // Generate the key locally and send a CSR
+	enrollKeyFile *string     // Path to store the key while enrolling
+	keyType       *string     // Type of the key generated to enroll
+	keyBits       *int        // Size of the key generated to enroll
 	dbFile        *string     // File to persist the state
+	dbDriver      *string     // Database used to persist the state
+	historyKeep   *int        // Number of requests kept on the history
+	historyDays   *int        // Days the requests are kept on the history
 	daemonFlag    *bool       // Start in daemon mode
 	pid           *string     // Path to PID file
 	logFile       *string     // Log file
 	nodenameFile  *string     // File to store nodename
+	nodenameMode  fileMode    // Permissions of the nodename file
+	nodenameOwner *string     // Owner of the nodename file
+	hashFile      *string     // File holding the hash, removed on deregister
 	scriptFile    *string     // Script to call after the certificate has been obtained
 	scriptLogFile *string     // Log to save the result of the script called
+	renewBefore   *int        // Time before the expiration to renew the certificate
+	renewScript   *string     // Script to call after the certificate has been renewed
+	backupDir     *string     // Directory to keep the replaced credentials
+	backupKeep    *int        // Number of backups kept
 	si            *sysinfo.SI // System information
 )
 
 // Global logger
 var logger = logrus.New()
 
+// Source of time used to wait between requests
+var clock Clock = realClock{}
+
 // init parses flags
 func init() {
 	scriptFile = flag.String("script", "/opt/rb/bin/rb_register_finish.sh", "Script to call after the certificate has been obtained")
+	renewBefore = flag.Int("renew-before", 720, "Time in hours before the certificate expires to renew it (0 to disable)")
+	renewScript = flag.String("renew-script", "", "Script to call after the certificate has been renewed")
+	backupDir = flag.String("backup-dir", "/var/lib/rb-register/backups", "Directory to keep the replaced certificates and nodenames")
+	backupKeep = flag.Int("backup-keep", 5, "Number of backups kept (0 to disable)")
 	debug = flag.Bool("debug", false, "Show debug info")
-	apiURL = flag.String("url", "http://localhost", "Protocol and hostname to connect")
+	flag.Var(&apiURLs, "url", "Protocol and hostname to connect, can be repeated or comma separated in priority order (default \"http://localhost\")")
+	discover = flag.String("discover", "", "Find the API from the _rb-register._tcp SRV records of this domain")
+	discoverHTTP = flag.Bool("discover-http", false, "Accept managers discovered on DNS over plain http")
 	hash = flag.String("hash", "00000000-0000-0000-0000-000000000000", "Hash to use in the request")
-	sleepTime = flag.Int("sleep", 300, "Time between requests in seconds")
+	sleepTime = flag.Int("sleep", 300, "Maximum time between requests in seconds")
+	backoffInit = flag.Int("backoff-initial", 5, "Initial time between requests in seconds")
+	backoffMult = flag.Float64("backoff-multiplier", 2, "Factor applied to the time between requests after each attempt")
+	backoffJitter = flag.Float64("backoff-jitter", 0.2, "Fraction of the time between requests to randomize (0 to 1)")
+	claimFast = flag.Int("claim-fast", 10, "Time between requests in seconds while waiting to be claimed")
+	claimFastFor = flag.Int("claim-fast-for", 600, "Time in seconds to use the fast interval before falling back to -sleep")
+	timeout = flag.Int("timeout", 60, "Maximum time for a single request in seconds")
 	deviceAlias = flag.String("type", "", "Type of the registering device")
 	insecure = flag.Bool("no-check-certificate", false, "Dont check if the certificate is valid")
+	bootstrapCert = flag.String("bootstrap-cert", "", "Identity certificate presented to the API over mTLS")
+	bootstrapKey = flag.String("bootstrap-key", "", "Private key of the identity certificate")
+	caFile = flag.String("ca-file", "", "CA bundle used to verify the certificate of the API")
+	flag.Var(&pinnedKeys, "pin-sha256", "Base64 SHA-256 hash of the public key of the API (can be repeated)")
+	signingKey = flag.String("signing-key", "", "Public key or certificate of the manager, responses not signed with it are rejected")
+	proxy = flag.String("proxy", "", "Proxy URL (http://, https:// or socks5://), with optional user:password")
+	noProxy = flag.String("no-proxy", "", "Comma separated list of hosts to reach without the proxy")
 	certFile = flag.String("cert", "/opt/rb/etc/chef/client.pem", "Certificate file")
+	certMode = 0600
+	flag.Var(&certMode, "cert-mode", "Permissions of the certificate file in octal")
+	certOwner = flag.String("cert-owner", "", "Owner of the certificate file as user[:group] (default current user)")
+	keyOut = flag.String("key-out", "", "File to store the private key alone, with the mode and owner of the certificate file")
+	certOut = flag.String("cert-out", "", "File to store the certificate followed by the intermediates, without the key")
+	caOut = flag.String("ca-out", "", "File to store the CA certificate of the manager")
+	enroll = flag.Bool("enroll", false, "Generate the private key locally and send a CSR instead of receiving a key")
+	enrollKeyFile = flag.String("enroll-key", "", "File to keep the generated key until the certificate is received (default cert file + \".key\")")
+	keyType = flag.String("key-type", "rsa", "Type of the generated key (rsa or ecdsa)")
+	keyBits = flag.Int("key-bits", 2048, "Size of the generated key in bits, or curve size for ecdsa keys")
 	dbFile = flag.String("db", "", "File to persist the state")
+	historyKeep = flag.Int("history-keep", defaultHistoryKeep, "Number of requests kept on the history (0 for no limit)")
+	historyDays = flag.Int("history-days", int(defaultHistoryAge/(24*time.Hour)), "Days the requests are kept on the history (0 for no limit)")
+	dbDriver = flag.String("db-driver", "", "Database used to persist the state: sqlite3, json or bolt (default sqlite3 if built with cgo, json otherwise)")
 	daemonFlag = flag.Bool("daemon", false, "Start in daemon mode")
 	pid = flag.String("pid", "pid", "File containing PID")
 	logFile = flag.String("log", "log", "Log file")
 	nodenameFile = flag.String("nodename", "", "File to store nodename")
+	nodenameMode = 0644
+	flag.Var(&nodenameMode, "nodename-mode", "Permissions of the nodename file in octal")
+	nodenameOwner = flag.String("nodename-owner", "", "Owner of the nodename file as user[:group] (default current user)")
+	hashFile = flag.String("hash-file", "/etc/rb-uuid", "File holding the hash of the device, removed on deregister")
 	versionFlag := flag.Bool("version", false, "Display version")
 
 	flag.Parse()
@@ -77,6 +155,10 @@ func init() {
 		os.Exit(0)
 	}
 
+	if len(apiURLs) == 0 && len(*discover) == 0 {
+		apiURLs = stringList{"http://localhost"}
+	}
+
 	// Init logger
 	if *debug {
 		logger.Level = logrus.DebugLevel
@@ -84,7 +166,28 @@ func init() {
 }
 
 func main() {
-	var db *Database
+	var db StateStore
+
+	// Cancel any pending request when the process is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Subcommands that only work with the local files
+	switch flag.Arg(0) {
+	case "", "deregister":
+	case "rollback":
+		os.Exit(rollbackCommand(flag.Args()[1:]))
+	case "history":
+		os.Exit(historyCommand(flag.Args()[1:]))
+	case "export":
+		os.Exit(exportCommand(flag.Args()[1:]))
+	case "import":
+		os.Exit(importCommand(flag.Args()[1:]))
+	default:
+		flag.Usage()
+		logger.Fatalf("Unknown command: %s", flag.Arg(0))
+	}
+
 	if len(*deviceAlias) == 0 {
 		flag.Usage()
 		logger.Fatal("You must provide a device alias")
@@ -97,95 +200,356 @@ func main() {
 
 	si = sysinfo.Get()
 
+	// Files written once the device is claimed. The private key is only
+	// readable as configured for the certificate file, the rest are public.
+	certOutput, err := newOutput(*certFile, certMode, *certOwner)
+	if err != nil {
+		logger.Fatalf("Invalid certificate owner: %s", err)
+	}
+	credentialOutputs := CredentialOutputs{
+		Bundle: certOutput,
+		Key:    Output{Path: *keyOut, Mode: certOutput.Mode, UID: certOutput.UID, GID: certOutput.GID},
+		Cert:   Output{Path: *certOut, Mode: 0644, UID: certOutput.UID, GID: certOutput.GID},
+		CA:     Output{Path: *caOut, Mode: 0644, UID: certOutput.UID, GID: certOutput.GID},
+	}
+	nodenameOutput, err := newOutput(*nodenameFile, nodenameMode, *nodenameOwner)
+	if err != nil {
+		logger.Fatalf("Invalid nodename owner: %s", err)
+	}
+	if len(*enrollKeyFile) == 0 {
+		*enrollKeyFile = *certFile + ".key"
+	}
+
+	if flag.Arg(0) == "deregister" {
+		files := append(credentialOutputs.List(), nodenameOutput,
+			Output{Path: *enrollKeyFile}, Output{Path: *hashFile})
+		os.Exit(deregisterCommand(ctx, flag.Args()[1:], newClientConfig(apiURLs, deviceType), files))
+	}
+
 	if *daemonFlag {
 		daemonize()
 	}
 
 	if len(*dbFile) > 0 {
-		db = NewDatabase(DatabaseConfig{dbFile: *dbFile})
-		if db == nil {
-			logger.Errorln("Error opening database")
-			halt()
+		if db, err = openStateStore(false); err != nil {
+			logger.Errorln(err)
+			halt(ctx)
 		}
 		defer db.Close()
 	}
 
+	// Policies used to wait between requests so sensors don't flood the server.
+	// Configurations made before the backoff existed may have a -sleep shorter
+	// than the new intervals, which are capped to it.
+	if *backoffInit > *sleepTime {
+		logger.Warnf("-backoff-initial %d is longer than -sleep, using %d", *backoffInit, *sleepTime)
+		*backoffInit = *sleepTime
+	}
+	if *claimFast > *sleepTime {
+		logger.Warnf("-claim-fast %d is longer than -sleep, using %d", *claimFast, *sleepTime)
+		*claimFast = *sleepTime
+	}
+	registerPolicy := NewBackoff(BackoffConfig{
+		Initial:    time.Duration(*backoffInit) * time.Second,
+		Max:        time.Duration(*sleepTime) * time.Second,
+		Multiplier: *backoffMult,
+		Jitter:     *backoffJitter,
+	})
+	if registerPolicy == nil {
+		logger.Fatal("Invalid backoff configuration")
+	}
+	claimPolicy := NewClaimSchedule(ClaimScheduleConfig{
+		Fast:    time.Duration(*claimFast) * time.Second,
+		FastFor: time.Duration(*claimFastFor) * time.Second,
+		Slow:    time.Duration(*sleepTime) * time.Second,
+		Jitter:  *backoffJitter,
+		Clock:   clock,
+	})
+	if claimPolicy == nil {
+		logger.Fatal("Invalid claim wait configuration")
+	}
+
+	// Find the managers on DNS, the urls given on the command line are only
+	// used as fallback
+	urls := apiURLs
+	if len(*discover) > 0 {
+		discovered, err := discoveryProcess(ctx, *discover, len(urls) > 0, registerPolicy)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		urls = append(discovered, urls...)
+		registerPolicy.Reset()
+	}
+
+	// The private key is generated on the device and only a CSR is sent
+	var enrollKey crypto.Signer
+	var csr string
+	if *enroll {
+		keyOutput := certOutput
+		keyOutput.Path = *enrollKeyFile
+		if enrollKey, err = loadOrGenerateKey(keyOutput, *keyType, *keyBits); err != nil {
+			logger.Fatalf("Error loading enrollment key: %s", err)
+		}
+		if csr, err = createCSR(enrollKey, *hash); err != nil {
+			logger.Fatalf("Error creating CSR: %s", err)
+		}
+	}
+
 	// Create a new API client for handle the connection with the API
-	apiClient := NewAPIClient(
-		APIClientConfig{
-			URL:        *apiURL,
-			Hash:       *hash,
-			Cpus:       runtime.NumCPU(),
-			Memory:     si.TotalRam,
-			DeviceType: deviceType,
-			Insecure:   *insecure,
-		},
-	)
+	clientConfig := newClientConfig(urls, deviceType)
+	clientConfig.CSR = csr
+	clientConfig.History = db
+	apiClient := NewAPIClient(clientConfig)
+	if apiClient == nil {
+		logger.Fatal("Invalid API client configuration")
+	}
 
-	uuid, err := registrationProcess(apiClient, db)
+	// Resume the registration from the status it was left on
+	state, err := loadState(db, urls)
 	if err != nil {
-		logger.Errorf("Registration failed: %v", err)
-		halt()
+		logger.Errorf("Error loading state: %v", err)
+		halt(ctx)
+	}
+	if state.Status != stateRegistering {
+		logger.Infof("Resuming registration on %s status", state.Status)
+	}
+	if len(state.Manager) > 0 {
+		apiClient.SetEndpoint(state.Manager)
 	}
-	logger.Infoln("Registration completed")
 
-	cert, nodename, err := verificationProcess(uuid, apiClient, db)
-	if err != nil {
-		logger.Errorf("Verification failed: %v", err)
-		halt()
+	if state.Status == stateRegistering {
+		if err := registrationProcess(ctx, apiClient, db, state, registerPolicy); err != nil {
+			logger.Errorf("Registration failed: %v", err)
+			halt(ctx)
+		}
+		logger.Infoln("Registration completed")
+	}
+
+	// Credentials installed before a restart are not requested again
+	var creds *Credentials
+	var nodename string
+	if state.Status == stateRegistered || state.Status == stateClaimed && !credentialsInstalled(state) {
+		creds, nodename, err = verificationProcess(ctx, apiClient, db, state, claimPolicy, enrollKey)
+		if err != nil {
+			logger.Errorf("Verification failed: %v", err)
+			halt(ctx)
+		}
+		logger.Infoln("Verification completed")
 	}
-	logger.Infoln("Verification completed")
 
-	if len(cert) > 0 && certFile != nil {
-		if err := ioutil.WriteFile(*certFile, []byte(cert), os.ModePerm); err != nil {
+	// Keep the current files in case the finish script fails with the new ones
+	backups := newBackups()
+	var generation string
+	if backups != nil && (creds != nil || len(nodename) > 0) {
+		outputs := append(credentialOutputs.List(), nodenameOutput)
+		if generation, err = backups.Save(outputs...); err != nil {
+			logger.Fatalf("Error saving backup: %s", err)
+		}
+		logger.Infof("Previous credentials saved on backup %s", generation)
+	}
+
+	if creds != nil {
+		if err := credentialOutputs.Write(creds); err != nil {
 			logger.Fatalf("Error saving certificate: %s", err.Error())
 		} else {
 			logger.Debugf("Certificate saved on %s", *certFile)
 		}
 	}
 
+	// The key is now stored along with the certificate
+	if enrollKey != nil && creds != nil {
+		os.Remove(*enrollKeyFile)
+	}
+
 	if len(nodename) > 0 && len(*nodenameFile) > 0 {
-		if err := ioutil.WriteFile(*nodenameFile, []byte(nodename), os.ModePerm); err != nil {
+		if err := nodenameOutput.Write([]byte(nodename)); err != nil {
 			logger.Fatalf("Error saving nodename: %s", err.Error())
 		} else {
 			logger.Debugf("Nodename saved on %s", *nodenameFile)
 		}
 	}
 
-	logger.Infoln("Calling finish script")
-	if err := endScript(*scriptFile, *logFile); err != nil {
-		logger.Error(err)
+	if state.Status == stateClaimed {
+		logger.Infoln("Calling finish script")
+		if err := endScript(*scriptFile, *logFile); err != nil {
+			logger.Errorf("Finish script failed: %v", err)
+			state.Attempt(err, clock.Now())
+
+			// Only earlier versions of the files are put back. On the first
+			// claim the new ones are kept, as the script may have already
+			// switched to them, and it is run again on the next start.
+			if len(generation) > 0 {
+				restored, err := backups.RestoreSaved(generation)
+				switch {
+				case err != nil:
+					logger.Errorf("Error restoring backup %s: %v", generation, err)
+				case restored:
+					logger.Warnf("Backup %s restored", generation)
+				default:
+					logger.Warnln("No previous credentials to restore, the finish script will be retried")
+				}
+			}
+		} else {
+			state.Transition(stateProvisioned, clock.Now())
+		}
+		saveState(db, state)
+	}
+
+	if *renewBefore <= 0 {
+		logger.Info("Halted")
+		<-ctx.Done() // Wait until asked to stop
+		return
+	}
+
+	// Keep the certificate up to date while running, using the current one as
+	// proof of identity
+	clientConfig.CSR = ""
+	registerPolicy.Reset()
+	renewer := NewRenewer(RenewerConfig{
+		Client:   clientConfig,
+		UUID:     state.UUID,
+		Endpoint: apiClient.Endpoint(),
+		Outputs:  credentialOutputs,
+		Nodename: nodenameOutput,
+		Before:   time.Duration(*renewBefore) * time.Hour,
+		Enroll:   *enroll,
+		KeyType:  *keyType,
+		KeyBits:  *keyBits,
+		Hook:     *renewScript,
+		HookLog:  *logFile,
+		Policy:   registerPolicy,
+		Backups:  backups,
+		Renewed: func(creds *Credentials) {
+			state.Fingerprint = creds.Fingerprint()
+			state.Transition(stateProvisioned, clock.Now())
+			saveState(db, state)
+		},
+		Clock:  clock,
+		Logger: logrus.NewEntry(logger),
+	})
+	if renewer == nil {
+		logger.Fatal("Invalid renewal configuration")
 	}
+	switch err := renewer.Run(ctx); {
+	case errors.Is(err, errNoCertificate):
+		logger.Warnf("Certificate renewal disabled: %v", err)
+		logger.Info("Halted")
+		<-ctx.Done() // Wait until asked to stop
+	case errors.Is(err, errHookFailed):
+		logger.Errorf("Certificate renewal stopped, fix the renewal hook and restart: %v", err)
+		logger.Info("Halted")
+		<-ctx.Done()
+	}
+}
 
-	logger.Info("Halted")
-	select {} // Wait forever
+// newClientConfig creates the API client configuration given on the command
+// line for the given managers
+func newClientConfig(urls []string, deviceType int) APIClientConfig {
+	return APIClientConfig{
+		URLs:       urls,
+		Hash:       *hash,
+		Cpus:       runtime.NumCPU(),
+		Memory:     si.TotalRam,
+		DeviceType: deviceType,
+		Insecure:   *insecure,
+		Timeout:    time.Duration(*timeout) * time.Second,
+
+		MaxRetryAfter: time.Duration(*sleepTime) * time.Second,
+
+		ClientCertFile: *bootstrapCert,
+		ClientKeyFile:  *bootstrapKey,
+		CAFile:         *caFile,
+		PinnedKeys:     pinnedKeys,
+		SigningKeyFile: *signingKey,
+		Proxy:          *proxy,
+		NoProxy:        *noProxy,
+		Logger:         logrus.NewEntry(logger),
+	}
 }
 
-// registrationProccess tries to register the device. I will send "register"
-// requests to the server and then wait for a "registered" response containing
-// an UUID. Once the UUID is obtained, if a database name is provided the
-// UUID will be persisted for future requests.
-func registrationProcess(apiClient *APIClient, db *Database) (uuid string, err error) {
-	if db != nil {
-		uuid, err = db.LoadUUID(*hash)
-		logger.Info("Loading UUID from database")
-		
+// loadState loads the registration state of the device from the database.
+// Without a state, the device is resumed as registered if a manager of urls,
+// in priority order, issued a UUID for the hash. UUIDs saved by older versions
+// are not bound to any manager.
+func loadState(db StateStore, urls []string) (*State, error) {
+	if db == nil {
+		return newState(*hash), nil
+	}
+
+	logger.Info("Loading state from database")
+	state, err := db.LoadState(*hash)
+	if err != nil || state != nil {
+		return state, err
+	}
+
+	state = newState(*hash)
+	for _, manager := range append(append([]string{}, urls...), "") {
+		uuid, err := db.LoadUUID(manager, *hash)
 		if err != nil {
-			// logger.Error("Failed to load from DB")
-			return // Error
+			return nil, err
 		}
 		if len(uuid) > 0 {
-			logger.Debugln("Loaded UUID from database")
-			return // Found UUID
+			logger.WithField("manager", manager).Debugln("Loaded UUID from database")
+			state.UUID = uuid
+			state.Manager = manager
+			state.Status = stateRegistered
+			break
 		}
-		logger.Debug(uuid)
 	}
 
+	return state, nil
+}
+
+// saveState persists the registration state, if there is a database
+func saveState(db StateStore, state *State) {
+	if db == nil {
+		return
+	}
+
+	if err := db.StoreState(state); err != nil {
+		logger.Errorf("Error saving state: %v", err)
+	}
+}
+
+// credentialsInstalled checks if the certificate received on the claim is the
+// one installed
+func credentialsInstalled(state *State) bool {
+	if len(state.Fingerprint) == 0 {
+		return false
+	}
+
+	creds, err := readCredentials(*certFile)
+	if err != nil {
+		return false
+	}
+
+	return creds.Fingerprint() == state.Fingerprint
+}
+
+// registrationProccess tries to register the device. I will send "register"
+// requests to the server and then wait for a "registered" response containing
+// an UUID. Once the UUID is obtained, if a database name is provided the
+// UUID will be persisted for future requests. Every attempt is recorded on
+// state. The time between requests is given by policy and the process is
+// aborted as soon as ctx is done.
+func registrationProcess(ctx context.Context, apiClient *APIClient, db StateStore, state *State, policy RetryPolicy) (err error) {
+	var uuid string
 	for {
 		logger.Debugln("Requesting new UUID")
-		uuid, err = apiClient.Register()
+		uuid, err = apiClient.RegisterContext(ctx)
+		if delay, ok := retryDelay(err, policy); ok {
+			logger.Warnf("Register postponed %v: %v", delay, err)
+			state.Attempt(err, clock.Now())
+			saveState(db, state)
+			if err = sleepContext(ctx, clock, delay); err != nil {
+				return
+			}
+			continue
+		}
 		if err != nil {
-			logger.Error("api client register")
+			logger.Errorf("Register rejected: %v", err)
+			state.Attempt(err, clock.Now())
+			saveState(db, state)
 			return
 		}
 		if apiClient.IsRegistered() {
@@ -193,12 +557,24 @@ func registrationProcess(apiClient *APIClient, db *Database) (uuid string, err e
 		}
 
 		// Don't flood the server
-		time.Sleep(time.Duration(*sleepTime) * time.Second)
+		state.Attempt(nil, clock.Now())
+		saveState(db, state)
+		if err = sleepContext(ctx, clock, policy.Next()); err != nil {
+			return
+		}
 	}
 
+	state.UUID = uuid
+	state.Manager = apiClient.Endpoint()
+	state.Transition(stateRegistered, clock.Now())
+	saveState(db, state)
+
 	if db != nil {
-		db.StoreUUID(*hash, uuid)
-		logger.WithField("uuid", uuid).Debugf("UUID saved to database")
+		if err := db.StoreUUID(state.Manager, *hash, uuid); err != nil {
+			logger.Errorf("Error saving UUID: %v", err)
+		} else {
+			logger.WithField("uuid", uuid).Debugf("UUID saved to database")
+		}
 	}
 
 	return
@@ -206,36 +582,119 @@ func registrationProcess(apiClient *APIClient, db *Database) (uuid string, err e
 
 // verificationProccess sends "verify" requests and waits for an "claimed"
 // response. The first "claimed" response should contain a certificate and
-// a node name that must be saved to disk.
-func verificationProcess(uuid string, apiClient *APIClient, db *Database) (cert, nodename string, err error) {
+// a node name that must be saved to disk, it may also contain the key, the
+// intermediates and the CA apart. If the certificate is not valid it is
+// requested again. When enrolling, the certificate is joined with the
+// local enrollKey. Every attempt is recorded on state. The time between
+// requests is given by policy and the process is aborted as soon as ctx is
+// done.
+func verificationProcess(ctx context.Context, apiClient *APIClient, db StateStore, state *State, policy RetryPolicy, enrollKey crypto.Signer) (creds *Credentials, nodename string, err error) {
 	for {
 		logger.Debugln("Requesting verification")
-		err = apiClient.Verify(uuid)
-		if err != nil {
+		err = apiClient.VerifyContext(ctx, state.UUID)
+		if delay, ok := retryDelay(err, policy); ok {
+			logger.Warnf("Verify postponed %v: %v", delay, err)
+			state.Attempt(err, clock.Now())
+			saveState(db, state)
+			if err = sleepContext(ctx, clock, delay); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrAlreadyClaimed) {
+			logger.Errorf("Verify rejected: %v", err)
+			state.Attempt(err, clock.Now())
+			saveState(db, state)
 			return
 		}
 		if apiClient.IsClaimed() {
-			break
+			if creds, nodename, err = claimedCredentials(apiClient, enrollKey); err == nil {
+				break
+			}
+			logger.Errorf("Invalid certificate received, requesting it again: %v", err)
+			apiClient.RejectClaim()
+			state.Attempt(err, clock.Now())
+		} else {
+			state.Attempt(nil, clock.Now())
 		}
+		saveState(db, state)
 
 		// Don't flood the server
-		time.Sleep(time.Duration(*sleepTime) * time.Second)
+		if err = sleepContext(ctx, clock, policy.Next()); err != nil {
+			return
+		}
+	}
+
+	state.Nodename = nodename
+	if creds != nil {
+		state.Fingerprint = creds.Fingerprint()
 	}
+	state.Transition(stateClaimed, clock.Now())
+	saveState(db, state)
 
-	// It is necessary to convert '\n' to actual line breaks
-	// and remove the quotes
-	cert = apiClient.GetCertificate()
-	if len(cert) > 0 {
-		cert = strings.Replace(cert, "\\n", "\n", -1)
-		cert = strings.Replace(cert, `"`, ``, -1)
+	return
+}
+
+// claimedCredentials gets the certificate and the node name received when the
+// device was claimed, and checks the certificate is valid before it is saved.
+// It returns nil credentials if no certificate was received.
+func claimedCredentials(apiClient *APIClient, enrollKey crypto.Signer) (creds *Credentials, nodename string, err error) {
+	claim := apiClient.GetClaim()
+	nodename = claim.Nodename
+	if len(claim.Cert) == 0 && len(claim.Key) == 0 {
+		return
 	}
 
-	nodename = apiClient.GetNodename()
+	creds, legacy, err := receivedCredentials(claim, enrollKey, *hash, clock.Now())
+	if legacy {
+		logger.Warnln("Manager doesn't support CSR enrollment, using the key it sent")
+	}
 
 	return
 }
 
-func halt() {
+// discoveryProcess looks up the managers of a domain on DNS. Lookups are
+// repeated following policy until they succeed, unless there are fallback
+// urls to use instead. The process is aborted as soon as ctx is done.
+func discoveryProcess(ctx context.Context, domain string, fallback bool, policy RetryPolicy) (urls []string, err error) {
+	for {
+		logger.Debugf("Discovering managers of %s", domain)
+		urls, err = discoverEndpoints(ctx, net.DefaultResolver, domain, *discoverHTTP, nil)
+		if err == nil {
+			logger.Infof("Discovered managers: %s", strings.Join(urls, ", "))
+			return
+		}
+		if fallback {
+			logger.Warnf("Discovery failed, using given urls: %v", err)
+			return
+		}
+
+		logger.Warnf("Discovery failed: %v", err)
+		if err = sleepContext(ctx, clock, policy.Next()); err != nil {
+			return
+		}
+	}
+}
+
+// retryDelay checks if err is a temporary failure so the request should be
+// repeated. In that case it returns the time the API asked to wait or, if it
+// didn't give one, the next delay of policy.
+func retryDelay(err error, policy RetryPolicy) (time.Duration, bool) {
+	if !isTemporary(err) {
+		return 0, false
+	}
+
+	var retryErr *RetryableError
+	if errors.As(err, &retryErr) && retryErr.RetryAfter > 0 {
+		return retryErr.RetryAfter, true
+	}
+
+	return policy.Next(), true
+}
+
+// halt stops doing any work and waits until the process is asked to stop
+func halt(ctx context.Context) {
 	logger.Error("Halted")
-	select {}
+	<-ctx.Done()
+	os.Exit(1)
 }
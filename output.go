@@ -0,0 +1,218 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mode of the parent directories created for an output
+const outputDirMode = 0755
+
+// Output describes a file produced by rb_register: where it is stored and who
+// can read it
+type Output struct {
+	Path string      // Destination of the file
+	Mode os.FileMode // Permissions of the file
+	UID  int         // Owner of the file, -1 to keep the current user
+	GID  int         // Group of the file, -1 to keep the current group
+}
+
+// CredentialOutputs are the files where the credentials received from the API
+// are saved. Outputs with an empty path are skipped.
+type CredentialOutputs struct {
+	Bundle Output // Private key followed by the certificates (client.pem)
+	Key    Output // Private key
+	Cert   Output // Certificate followed by the intermediates
+	CA     Output // CA certificates of the manager
+}
+
+// List returns every output, including the ones with an empty path
+func (o CredentialOutputs) List() []Output {
+	return []Output{o.Bundle, o.Key, o.Cert, o.CA}
+}
+
+// Write saves creds on every output. The bundle is written last, so it is only
+// replaced once the rest of the files are ready.
+func (o CredentialOutputs) Write(creds *Credentials) error {
+	if len(o.Key.Path) > 0 && creds.Key != nil {
+		key, err := creds.KeyPEM()
+		if err != nil {
+			return err
+		}
+		if err := o.Key.Write(key); err != nil {
+			return err
+		}
+	}
+	if len(o.Cert.Path) > 0 && len(creds.Certs) > 0 {
+		if err := o.Cert.Write(creds.CertsPEM()); err != nil {
+			return err
+		}
+	}
+	if len(o.CA.Path) > 0 && len(creds.CA) > 0 {
+		if err := o.CA.Write(creds.CAPEM()); err != nil {
+			return err
+		}
+	}
+	if len(o.Bundle.Path) > 0 {
+		bundle, err := creds.Bundle()
+		if err != nil {
+			return err
+		}
+		if err := o.Bundle.Write(bundle); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newOutput creates an Output for path with the given mode and owner, given as
+// "user[:group]"
+func newOutput(path string, mode fileMode, owner string) (Output, error) {
+	uid, gid, err := parseOwner(owner)
+	if err != nil {
+		return Output{}, err
+	}
+
+	return Output{Path: path, Mode: os.FileMode(mode), UID: uid, GID: gid}, nil
+}
+
+// Write atomically replaces the output with data. The data is written to a
+// temporary file on the same directory that is synced and renamed over the
+// destination, so a crash leaves either the old or the new content but never
+// a partial file. Missing parent directories are created.
+func (o Output) Write(data []byte) (err error) {
+	dir := filepath.Dir(o.Path)
+	if err := os.MkdirAll(dir, outputDirMode); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(o.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	// The mode is set explicitly so it doesn't depend on the umask, and before
+	// writing so the content is never readable by others
+	if err = tmp.Chmod(o.Mode); err != nil {
+		return err
+	}
+	if o.UID >= 0 || o.GID >= 0 {
+		if err = tmp.Chown(o.UID, o.GID); err != nil {
+			return err
+		}
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), o.Path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory so a rename on it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// parseOwner decodes an owner given as "user", "user:group" or ":group". Users
+// and groups can be names or numeric IDs. Missing parts are returned as -1.
+func parseOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if len(owner) == 0 {
+		return
+	}
+
+	userName, groupName := owner, ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+
+	if len(userName) > 0 {
+		if uid, err = strconv.Atoi(userName); err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return -1, -1, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+
+	if len(groupName) > 0 {
+		if gid, err = strconv.Atoi(groupName); err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return -1, -1, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, err
+			}
+		}
+	}
+
+	if uid < -1 || gid < -1 {
+		return -1, -1, errors.New("Invalid owner: " + owner)
+	}
+
+	return uid, gid, nil
+}
+
+// fileMode is a flag holding file permissions in octal
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return "0" + strconv.FormatUint(uint64(*m), 8)
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return errors.New("Invalid file mode: " + value)
+	}
+	*m = fileMode(mode)
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the output is written with the given mode regardless of the umask
+func Test_Output_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.pem")
+	out := Output{Path: path, Mode: 0600, UID: -1, GID: -1}
+
+	err := out.Write([]byte("first"))
+	assert.NoError(t, err, "Unexpected error")
+	err = out.Write([]byte("second"))
+	assert.NoError(t, err, "Unexpected error")
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "second", string(data), "Wrong content")
+	info, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Wrong mode")
+}
+
+// Test missing parent directories are created and no temporary file is left
+func Test_Output_Write_Parents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "etc", "chef", "nodename")
+	out := Output{Path: path, Mode: 0644, UID: -1, GID: -1}
+
+	err := out.Write([]byte("node"))
+	assert.NoError(t, err, "Unexpected error")
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1, "Temporary file left")
+	assert.Equal(t, "nodename", files[0].Name(), "Wrong file")
+}
+
+// Test the destination is untouched if it can't be replaced
+func Test_Output_Write_Failed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.pem")
+	os.Mkdir(path, 0755)
+	out := Output{Path: path, Mode: 0600, UID: -1, GID: -1}
+
+	err := out.Write([]byte("cert"))
+	assert.Error(t, err, "Expected error")
+
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1, "Temporary file left")
+}
+
+// Test owners given as IDs
+func Test_ParseOwner(t *testing.T) {
+	uid, gid, err := parseOwner("")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, -1, uid, "Wrong user")
+	assert.Equal(t, -1, gid, "Wrong group")
+
+	uid, gid, err = parseOwner("0:10")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, 0, uid, "Wrong user")
+	assert.Equal(t, 10, gid, "Wrong group")
+
+	uid, gid, err = parseOwner(":10")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, -1, uid, "Wrong user")
+	assert.Equal(t, 10, gid, "Wrong group")
+
+	_, _, err = parseOwner("no-such-user-rb")
+	assert.Error(t, err, "Expected error")
+}
+
+// Test file modes are parsed in octal
+func Test_FileMode(t *testing.T) {
+	var mode fileMode
+
+	assert.NoError(t, mode.Set("640"), "Unexpected error")
+	assert.Equal(t, fileMode(0640), mode, "Wrong mode")
+	assert.Equal(t, "0640", mode.String(), "Wrong string")
+
+	assert.Error(t, mode.Set("999"), "Expected error")
+	assert.Error(t, mode.Set("7777"), "Expected error")
+}
+
+// Test each part of the credentials is saved on its own file
+func Test_CredentialOutputs_Write(t *testing.T) {
+	dir := t.TempDir()
+	claim := testClaim(t)
+	creds, _, err := receivedCredentials(claim, nil, "", time.Now())
+	assert.NoError(t, err, "Unexpected error")
+	outputs := CredentialOutputs{
+		Bundle: Output{Path: filepath.Join(dir, "client.pem"), Mode: 0600, UID: -1, GID: -1},
+		Key:    Output{Path: filepath.Join(dir, "client.key"), Mode: 0600, UID: -1, GID: -1},
+		Cert:   Output{Path: filepath.Join(dir, "client.crt"), Mode: 0644, UID: -1, GID: -1},
+		CA:     Output{Path: filepath.Join(dir, "ca.crt"), Mode: 0644, UID: -1, GID: -1},
+	}
+
+	err = outputs.Write(creds)
+	assert.NoError(t, err, "Unexpected error")
+
+	expected := map[string]string{
+		"client.pem": claim.Key + claim.Cert + claim.Chain,
+		"client.key": claim.Key,
+		"client.crt": claim.Cert + claim.Chain,
+		"ca.crt":     claim.CA,
+	}
+	for name, content := range expected {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Equal(t, content, string(data), "Wrong "+name)
+	}
+}
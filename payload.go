@@ -0,0 +1,167 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+// Encodings of the certificate payloads, given on the cert_encoding field
+const (
+	pemEncoding    = "pem"    // Plain PEM
+	jsonEncoding   = "json"   // PEM escaped as a JSON string
+	base64Encoding = "base64" // Base64 of the PEM
+	derEncoding    = "der"    // Base64 of the DER
+)
+
+// Maximum number of nested JSON strings unwrapped when guessing the encoding
+const maxPayloadNesting = 3
+
+// decodePayload decodes a key or certificate payload sent by the API to PEM.
+// If encoding is empty it is guessed, since some managers double encode the
+// payloads.
+func decodePayload(payload, encoding string) (string, error) {
+	var data string
+	var err error
+
+	switch encoding {
+	case pemEncoding:
+		data = payload
+	case jsonEncoding:
+		data, err = unquotePayload(payload)
+	case base64Encoding:
+		data, err = decodeBase64PEM(payload)
+	case derEncoding:
+		data, err = decodeBase64DER(payload)
+	case "":
+		data, err = guessPayload(payload, maxPayloadNesting)
+	default:
+		return "", errors.New("Unknown certificate encoding: " + encoding)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, "-----BEGIN ") {
+		return "", errors.New("Payload is not PEM encoded")
+	}
+
+	return data + "\n", nil
+}
+
+// guessPayload detects the encoding of a payload and decodes it
+func guessPayload(payload string, nesting int) (string, error) {
+	payload = strings.TrimSpace(payload)
+
+	switch {
+	case strings.HasPrefix(payload, `"`):
+		if nesting == 0 {
+			return "", errors.New("Payload nested too deep")
+		}
+		data, err := unquotePayload(payload)
+		if err != nil {
+			return "", err
+		}
+		return guessPayload(data, nesting-1)
+
+	case strings.HasPrefix(payload, "-----BEGIN "):
+		// PEM with its line breaks escaped but without the quotes
+		if !strings.Contains(payload, "\n") && strings.Contains(payload, `\n`) {
+			return unquotePayload(`"` + payload + `"`)
+		}
+		return payload, nil
+	}
+
+	data, err := decodeBase64(payload)
+	if err != nil {
+		return "", errors.New("Unknown certificate encoding")
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN ")) {
+		return string(data), nil
+	}
+
+	return derToPEM(data)
+}
+
+// unquotePayload decodes a PEM escaped as a JSON string
+func unquotePayload(payload string) (string, error) {
+	var data string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(payload)), &data); err != nil {
+		return "", errors.New("Invalid JSON string payload")
+	}
+
+	return data, nil
+}
+
+// decodeBase64PEM decodes a base64 encoded PEM
+func decodeBase64PEM(payload string) (string, error) {
+	data, err := decodeBase64(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// decodeBase64DER decodes a base64 encoded DER to PEM
+func decodeBase64DER(payload string) (string, error) {
+	data, err := decodeBase64(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return derToPEM(data)
+}
+
+// decodeBase64 decodes standard base64, ignoring line breaks
+func decodeBase64(payload string) ([]byte, error) {
+	payload = strings.Join(strings.Fields(payload), "")
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("Invalid base64 payload")
+	}
+
+	return data, nil
+}
+
+// derToPEM encodes DER data as PEM. The data may be one or more certificates
+// or a private key.
+func derToPEM(der []byte) (string, error) {
+	if certs, err := x509.ParseCertificates(der); err == nil && len(certs) > 0 {
+		return string(encodeCerts(certs)), nil
+	}
+
+	var blockType string
+	if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		blockType = "PRIVATE KEY"
+	} else if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		blockType = "RSA PRIVATE KEY"
+	} else if _, err := x509.ParseECPrivateKey(der); err == nil {
+		blockType = "EC PRIVATE KEY"
+	} else {
+		return "", errors.New("DER payload is not a certificate or a private key")
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to create a PEM key and certificate for a node
+func testPayload(t *testing.T) (keyPEM, certPEM string) {
+	claim := testClaim(t)
+
+	return claim.Key, claim.Cert
+}
+
+// Test plain PEM payloads
+func Test_DecodePayload_PEM(t *testing.T) {
+	_, cert := testPayload(t)
+
+	for _, encoding := range []string{"", pemEncoding} {
+		data, err := decodePayload(cert, encoding)
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, cert, data, "Wrong payload")
+	}
+
+	// The line break at the end is added if missing
+	data, err := decodePayload(strings.TrimSpace(cert), "")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, cert, data, "Wrong payload")
+}
+
+// Test PEM payloads escaped as JSON strings, with and without the quotes and
+// encoded twice
+func Test_DecodePayload_JSON(t *testing.T) {
+	_, cert := testPayload(t)
+	quoted, _ := json.Marshal(cert)
+	twice, _ := json.Marshal(string(quoted))
+
+	data, err := decodePayload(string(quoted), jsonEncoding)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, cert, data, "Wrong payload")
+
+	data, err = decodePayload(string(quoted), "")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, cert, data, "Wrong payload")
+
+	data, err = decodePayload(strings.Trim(string(quoted), `"`), "")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, cert, data, "Wrong payload")
+
+	data, err = decodePayload(string(twice), "")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, cert, data, "Wrong payload")
+}
+
+// Test base64 encoded PEM payloads
+func Test_DecodePayload_Base64(t *testing.T) {
+	key, cert := testPayload(t)
+	encoded := base64.StdEncoding.EncodeToString([]byte(key + cert))
+
+	for _, encoding := range []string{"", base64Encoding} {
+		data, err := decodePayload(encoded, encoding)
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, key+cert, data, "Wrong payload")
+	}
+}
+
+// Test base64 encoded DER payloads of certificates and keys
+func Test_DecodePayload_DER(t *testing.T) {
+	key, cert := testPayload(t)
+	keyBlock, _ := pem.Decode([]byte(key))
+	certBlock, _ := pem.Decode([]byte(cert))
+
+	for _, encoding := range []string{"", derEncoding} {
+		data, err := decodePayload(base64.StdEncoding.EncodeToString(certBlock.Bytes), encoding)
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, cert, data, "Wrong payload")
+
+		data, err = decodePayload(base64.StdEncoding.EncodeToString(keyBlock.Bytes), encoding)
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, key, data, "Wrong payload")
+	}
+}
+
+// Test quotes inside the payload are not stripped
+func Test_DecodePayload_Quotes(t *testing.T) {
+	payload := "-----BEGIN CERTIFICATE-----\nQUJD\"REVG\n-----END CERTIFICATE-----\n"
+
+	data, err := decodePayload(payload, pemEncoding)
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, payload, data, "Wrong payload")
+}
+
+// Test invalid payloads and encodings
+func Test_DecodePayload_Invalid(t *testing.T) {
+	_, cert := testPayload(t)
+
+	_, err := decodePayload(cert, "pkcs12")
+	assert.Error(t, err, "Expected error")
+
+	_, err = decodePayload(cert, derEncoding)
+	assert.Error(t, err, "Expected error")
+
+	_, err = decodePayload("not a certificate", "")
+	assert.Error(t, err, "Expected error")
+
+	_, err = decodePayload(base64.StdEncoding.EncodeToString([]byte("garbage")), "")
+	assert.Error(t, err, "Expected error")
+
+	_, err = decodePayload(`"""`, "")
+	assert.Error(t, err, "Expected error")
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newProxyFunc returns the function used by the HTTP transport to select the
+// proxy for a request. HTTP and HTTPS proxies are used through CONNECT for
+// HTTPS requests, SOCKS5 proxies for every request. Credentials given on the
+// proxy URL are sent to the proxy. Hosts on the no-proxy list, as well as
+// localhost, are always reached directly.
+func newProxyFunc(proxy, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.New("Invalid proxy URL")
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, errors.New("Unsupported proxy scheme: " + proxyURL.Scheme)
+	}
+	if len(proxyURL.Host) == 0 {
+		return nil, errors.New("Proxy host not provided")
+	}
+
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  proxy,
+		HTTPSProxy: proxy,
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}, nil
+}
+
+// redactURL hides the password of an URL so it can be logged
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errHookFailed is returned when the renewal hook fails and the previous
+// credentials are put back
+var errHookFailed = errors.New("Renewal hook failed")
+
+// Renewer watches the client certificate and asks the API for a new one before
+// it expires
+type Renewer struct {
+	config RenewerConfig
+}
+
+// NewRenewer creates a new Renewer. It returns nil if the configuration is not
+// valid.
+func NewRenewer(config RenewerConfig) *Renewer {
+	r := &Renewer{config: config}
+
+	if r.config.Logger == nil {
+		r.config.Logger = logrus.NewEntry(logrus.New())
+		r.config.Logger.Logger.Out = ioutil.Discard
+	} else {
+		r.config.Logger = r.config.Logger.WithFields(logrus.Fields{
+			"component": "renewer",
+		})
+	}
+
+	logger := r.config.Logger
+
+	if len(r.config.Outputs.Bundle.Path) == 0 {
+		logger.Warnf("Certificate not provided")
+		return nil
+	}
+	if r.config.Before <= 0 {
+		logger.Warnf("Renewal time not provided")
+		return nil
+	}
+	if r.config.Policy == nil {
+		logger.Warnf("Retry policy not provided")
+		return nil
+	}
+	if r.config.Clock == nil {
+		r.config.Clock = realClock{}
+	}
+
+	return r
+}
+
+// NextRenewal returns the time when the stored certificate must be renewed
+func (r *Renewer) NextRenewal() (time.Time, error) {
+	creds, err := readCredentials(r.config.Outputs.Bundle.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return creds.Certs[0].NotAfter.Add(-r.config.Before), nil
+}
+
+// Run waits until the certificate must be renewed and renews it. Failed
+// renewals are retried as given by the policy. It only returns when ctx is
+// done, if the installed credentials hold no certificate to renew, or if the
+// renewal hook fails, so a broken hook doesn't get a new certificate issued on
+// every retry.
+func (r *Renewer) Run(ctx context.Context) error {
+	logger := r.config.Logger
+	clock := r.config.Clock
+
+	for {
+		at, err := r.NextRenewal()
+		if errors.Is(err, errNoCertificate) {
+			return err
+		}
+		if err != nil {
+			logger.Errorf("Error reading certificate: %v", err)
+			if err := sleepContext(ctx, clock, r.config.Policy.Next()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if wait := at.Sub(clock.Now()); wait > 0 {
+			logger.Infof("Certificate renewal scheduled on %s", at.Format(time.RFC3339))
+			if err := sleepContext(ctx, clock, wait); err != nil {
+				return err
+			}
+		}
+
+		if err := r.Renew(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, errHookFailed) {
+				return err
+			}
+			logger.Errorf("Renewal failed: %v", err)
+			if err := sleepContext(ctx, clock, r.config.Policy.Next()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r.config.Policy.Reset()
+		logger.Infoln("Certificate renewed")
+	}
+}
+
+// Renew asks the API for a new certificate presenting the current one, saves
+// it in place of the current one and calls the hook. If the hook fails the
+// previous files are restored from the backup.
+func (r *Renewer) Renew(ctx context.Context) error {
+	logger := r.config.Logger
+
+	// The certificate file holds the key too
+	clientConfig := r.config.Client
+	clientConfig.ClientCertFile = r.config.Outputs.Bundle.Path
+	clientConfig.ClientKeyFile = r.config.Outputs.Bundle.Path
+	apiClient := NewAPIClient(clientConfig)
+	if apiClient == nil {
+		return errors.New("Invalid API client configuration")
+	}
+	if len(r.config.Endpoint) > 0 {
+		apiClient.SetEndpoint(r.config.Endpoint)
+	}
+
+	var key crypto.Signer
+	var csr string
+	if r.config.Enroll {
+		var err error
+		if key, err = generateKey(r.config.KeyType, r.config.KeyBits); err != nil {
+			return err
+		}
+		if csr, err = createCSR(key, clientConfig.Hash); err != nil {
+			return err
+		}
+	}
+
+	claim, err := apiClient.RenewContext(ctx, r.config.UUID, csr)
+	if err != nil {
+		return err
+	}
+
+	creds, legacy, err := receivedCredentials(claim, key, clientConfig.Hash, r.config.Clock.Now())
+	if err != nil {
+		return err
+	}
+	if legacy {
+		logger.Warnln("Manager doesn't support CSR enrollment, using the key it sent")
+	}
+
+	// Keep the current files in case the new ones don't work
+	var generation string
+	if r.config.Backups != nil {
+		outputs := append(r.config.Outputs.List(), r.config.Nodename)
+		if generation, err = r.config.Backups.Save(outputs...); err != nil {
+			return err
+		}
+	}
+
+	// Every file is put back if any of them can't be written
+	restore := func(err error) error {
+		if len(generation) == 0 {
+			return err
+		}
+		if restoreErr := r.config.Backups.Restore(generation); restoreErr != nil {
+			return fmt.Errorf("%w, restoring backup %s: %v", err, generation, restoreErr)
+		}
+		return fmt.Errorf("%w, backup %s restored", err, generation)
+	}
+
+	if err := r.config.Outputs.Write(creds); err != nil {
+		return restore(err)
+	}
+	logger.Debugf("Certificate saved on %s", r.config.Outputs.Bundle.Path)
+
+	if len(claim.Nodename) > 0 && len(r.config.Nodename.Path) > 0 {
+		if err := r.config.Nodename.Write([]byte(claim.Nodename)); err != nil {
+			return restore(err)
+		}
+		logger.Debugf("Nodename saved on %s", r.config.Nodename.Path)
+	}
+
+	if len(r.config.Hook) > 0 {
+		logger.Infoln("Calling renewal hook")
+		err := endScript(r.config.Hook, r.config.HookLog)
+		if err != nil && len(generation) > 0 {
+			return restore(fmt.Errorf("%w: %v", errHookFailed, err))
+		}
+		if err != nil {
+			logger.Errorf("Renewal hook failed: %v", err)
+		}
+	}
+
+	if r.config.Renewed != nil {
+		r.config.Renewed(creds)
+	}
+
+	return nil
+}
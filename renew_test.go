@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Handler that signs the CSR of renew requests with the given common name
+func renewHandlerFunc(t *testing.T, cn, nodename string) http.HandlerFunc {
+	caKey, _ := generateKey(ecdsaKey, 256)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["order"] != "renew" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		block, _ := pem.Decode([]byte(req["csr"]))
+		if block == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, caKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":   "claimed",
+			"cert":     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			"nodename": nodename,
+		})
+	}
+}
+
+// Helper function to create a renewer for a certificate expiring on notAfter
+func testRenewer(t *testing.T, client *http.Client, notAfter time.Time) *Renewer {
+	dir := t.TempDir()
+	key, _ := generateKey(ecdsaKey, 256)
+	certOutput := Output{Path: filepath.Join(dir, "client.pem"), Mode: 0600, UID: -1, GID: -1}
+	certOutput.Write(testBundle(t, key, "node", notAfter.Add(-time.Hour), notAfter))
+
+	clientConfig := validConfig
+	clientConfig.HTTPClient = client
+
+	return NewRenewer(RenewerConfig{
+		Client:   clientConfig,
+		UUID:     "00000000-0000-0000-0000-000000000000",
+		Outputs:  CredentialOutputs{Bundle: certOutput},
+		Nodename: Output{Path: filepath.Join(dir, "nodename"), Mode: 0644, UID: -1, GID: -1},
+		Before:   24 * time.Hour,
+		Enroll:   true,
+		KeyType:  ecdsaKey,
+		KeyBits:  256,
+		Policy:   NewBackoff(BackoffConfig{Initial: time.Second, Max: time.Minute, Multiplier: 2}),
+	})
+}
+
+// Test invalid renewer configurations
+func Test_NewRenewer_Invalid(t *testing.T) {
+	assert.Nil(t, NewRenewer(RenewerConfig{}), "Renewer should be nil")
+	assert.Nil(t, NewRenewer(RenewerConfig{
+		Outputs: CredentialOutputs{Bundle: Output{Path: "client.pem"}},
+	}), "Renewer should be nil")
+	assert.Nil(t, NewRenewer(RenewerConfig{
+		Outputs: CredentialOutputs{Bundle: Output{Path: "client.pem"}}, Before: time.Hour,
+	}), "Renewer should be nil")
+}
+
+// Test the renewal is scheduled before the expiration
+func Test_Renewer_NextRenewal(t *testing.T) {
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	renewer := testRenewer(t, nil, notAfter)
+
+	at, err := renewer.NextRenewal()
+
+	assert.NoError(t, err, "Unexpected error")
+	assert.True(t, notAfter.Add(-24*time.Hour).Equal(at), "Wrong renewal time")
+}
+
+// Test the certificate is replaced with a new one for a new key
+func Test_Renewer_Renew(t *testing.T) {
+	server, client := getTestHTTPClient(renewHandlerFunc(t, "node", "node"))
+	defer server.Close()
+	renewer := testRenewer(t, client, time.Now().Add(time.Hour))
+	old, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+	var renewed *Credentials
+	renewer.config.Renewed = func(creds *Credentials) { renewed = creds }
+
+	err := renewer.Renew(context.Background())
+	assert.NoError(t, err, "Unexpected error")
+
+	data, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+	assert.NotEqual(t, old, data, "Certificate not replaced")
+	creds, err := parseCredentials(data)
+	assert.NoError(t, err, "Unexpected error")
+	assert.NoError(t, creds.Validate("node", time.Now()), "Invalid certificate")
+	if assert.NotNil(t, renewed, "Renewal not notified") {
+		assert.Equal(t, creds.Fingerprint(), renewed.Fingerprint(), "Wrong credentials notified")
+	}
+
+	nodename, _ := ioutil.ReadFile(renewer.config.Nodename.Path)
+	assert.Equal(t, "node", string(nodename), "Wrong nodename")
+
+	at, _ := renewer.NextRenewal()
+	assert.True(t, at.After(time.Now().Add(300*24*time.Hour)), "Wrong renewal time")
+}
+
+// Test the certificate is kept if the new one is not valid
+func Test_Renewer_Renew_Invalid(t *testing.T) {
+	server, client := getTestHTTPClient(renewHandlerFunc(t, "other", "node"))
+	defer server.Close()
+	renewer := testRenewer(t, client, time.Now().Add(time.Hour))
+	old, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+
+	err := renewer.Renew(context.Background())
+	assert.Error(t, err, "Expected error")
+
+	data, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+	assert.Equal(t, old, data, "Certificate replaced")
+}
+
+// Test the renewer retries failed renewals until the context is done
+func Test_Renewer_Run_Retry(t *testing.T) {
+	var requests int32
+	server, client := getTestHTTPClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	renewer := testRenewer(t, client, time.Now().Add(time.Hour))
+	renewer.config.Clock = &fakeClock{now: time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := renewer.Run(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err, "Wrong error")
+	assert.True(t, atomic.LoadInt32(&requests) > 1, "Renewal not retried")
+}
+
+// Test the previous certificate is restored if the renewal hook fails
+func Test_Renewer_Hook_Failed(t *testing.T) {
+	server, client := getTestHTTPClient(renewHandlerFunc(t, "node", "node"))
+	defer server.Close()
+	renewer := testRenewer(t, client, time.Now().Add(time.Hour))
+	renewer.config.Backups, _ = testBackups(t, 5)
+	dir := t.TempDir()
+	renewer.config.Hook = filepath.Join(dir, "hook.sh")
+	renewer.config.HookLog = filepath.Join(dir, "hook.log")
+	ioutil.WriteFile(renewer.config.Hook, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	old, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+
+	err := renewer.Renew(context.Background())
+	assert.True(t, errors.Is(err, errHookFailed), "Wrong error")
+
+	data, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+	assert.Equal(t, old, data, "Certificate not restored")
+}
+
+// Test the renewer stops after the renewal hook fails instead of asking for a
+// new certificate again
+func Test_Renewer_Run_Hook_Failed(t *testing.T) {
+	var requests int32
+	handler := renewHandlerFunc(t, "node", "node")
+	server, client := getTestHTTPClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler(w, r)
+	})
+	defer server.Close()
+	renewer := testRenewer(t, client, time.Now().Add(time.Hour))
+	renewer.config.Backups, _ = testBackups(t, 5)
+	renewer.config.Hook = filepath.Join(t.TempDir(), "hook.sh")
+	ioutil.WriteFile(renewer.config.Hook, []byte("#!/bin/sh\nexit 1\n"), 0755)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := renewer.Run(ctx)
+
+	assert.True(t, errors.Is(err, errHookFailed), "Wrong error")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "Renewal retried")
+}
+
+// Test the certificate is restored if the nodename can't be written
+func Test_Renewer_Nodename_Failed(t *testing.T) {
+	server, client := getTestHTTPClient(renewHandlerFunc(t, "node", "node"))
+	defer server.Close()
+	renewer := testRenewer(t, client, time.Now().Add(time.Hour))
+	renewer.config.Backups, _ = testBackups(t, 5)
+	blocker := filepath.Join(t.TempDir(), "file")
+	ioutil.WriteFile(blocker, nil, 0600)
+	renewer.config.Nodename.Path = filepath.Join(blocker, "nodename")
+	old, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+
+	err := renewer.Renew(context.Background())
+	assert.Error(t, err, "Expected error")
+
+	data, _ := ioutil.ReadFile(renewer.config.Outputs.Bundle.Path)
+	assert.Equal(t, old, data, "Certificate not restored")
+}
+
+// Test the renewer stops if the credentials hold no certificate, as on legacy
+// devices
+func Test_Renewer_Run_Key_Only(t *testing.T) {
+	renewer := testRenewer(t, nil, time.Now().Add(time.Hour))
+	key, _ := generateKey(ecdsaKey, 256)
+	data, _ := encodeKey(key)
+	renewer.config.Outputs.Bundle.Write(data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := renewer.Run(ctx)
+
+	assert.True(t, errors.Is(err, errNoCertificate), "Wrong error")
+}
@@ -21,6 +21,9 @@ INSECURE=0
 DNS=0
 START=1
 DNSF=0
+CAFILE=""
+PIN=""
+SIGNKEY=""
 
 source /usr/lib/redborder/lib/rb_functions.sh
 
@@ -29,6 +32,9 @@ function usage(){
   	echo "    -u <url>: url to connect to"
     echo "    -c <cloud_domain>: specify the cloud domain"
   	echo "    -i: do not validate server cert (insecure)"
+  	echo "    -a <ca_file>: validate server cert using this CA bundle"
+  	echo "    -p <pin>: base64 SHA-256 of the server public key to pin"
+  	echo "    -k <key_file>: reject responses not signed with this manager public key"
   	echo "    -d: add dns entries to /etc/hosts in case it is not resolvable and the url is an ip"
     echo "    -f: add the dns entry even if it is a domain (it will try to resolv the ip address)"
   	echo "    -s: do no start services"
@@ -39,7 +45,7 @@ function usage(){
 # Default values
 TYPE="proxy"
 
-while getopts "hu:idsft:c:" opt; do
+while getopts "hu:idsft:c:a:p:k:" opt; do
   case $opt in
     i) INSECURE=1;;
     u) RBDOMAIN=$OPTARG;;
@@ -49,6 +55,9 @@ while getopts "hu:idsft:c:" opt; do
     f) DNSF=1;;
     s) START=0;;
     t) TYPE=$OPTARG;;
+    a) CAFILE=$OPTARG;;
+    p) PIN=$OPTARG;;
+    k) SIGNKEY=$OPTARG;;
   esac
 done
 
@@ -105,6 +114,15 @@ else
   done
 fi
 
+for n in /etc/sysconfig/rb-register.default /etc/sysconfig/rb-register; do
+  if [ -f $n ]; then
+    sed -i 's/-ca-file [^ "]* *//; s/-pin-sha256 [^ "]* *//g; s/-signing-key [^ "]* *//g' $n
+    [ "x$CAFILE" != "x" ] && sed -i "s|^OPTIONS=\"|OPTIONS=\"-ca-file $CAFILE |" $n
+    [ "x$PIN" != "x" ] && sed -i "s|^OPTIONS=\"|OPTIONS=\"-pin-sha256 $PIN |" $n
+    [ "x$SIGNKEY" != "x" ] && sed -i "s|^OPTIONS=\"|OPTIONS=\"-signing-key $SIGNKEY |" $n
+  fi
+done
+
 #if [ $DNS -eq 1 ]; then
 RBDOMAINIP=""
 if valid_ip $RBDOMAIN; then
@@ -142,4 +160,13 @@ if [ $INSECURE -eq 1 ]; then
   echo "disabled"
 else
   echo "enabled"
-fi
\ No newline at end of file
+fi
+if [ "x$CAFILE" != "x" ]; then
+  echo "CA bundle: $CAFILE"
+fi
+if [ "x$PIN" != "x" ]; then
+  echo "Pinned key: $PIN"
+fi
+if [ "x$SIGNKEY" != "x" ]; then
+  echo "Signing key: $SIGNKEY"
+fi
@@ -0,0 +1,216 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	// Hashes used by the signature algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Header holding the detached JWS signature of the response body
+const signatureHeader = "X-JWS-Signature"
+
+// Type of the Ed25519 keys, along with the ones that can be generated
+const ed25519Key = "ed25519"
+
+// jwsAlgorithm describes a JWS signature algorithm
+type jwsAlgorithm struct {
+	kind  string         // Type of key
+	hash  crypto.Hash    // Hash of the signed data, none for EdDSA
+	pss   bool           // RSASSA-PSS instead of PKCS #1 v1.5
+	curve elliptic.Curve // Curve of the ECDSA key
+}
+
+// Supported JWS algorithms. "none" and the HMAC ones are not accepted, since
+// they would allow anybody to sign the responses.
+var jwsAlgorithms = map[string]jwsAlgorithm{
+	"RS256": {kind: rsaKey, hash: crypto.SHA256},
+	"RS384": {kind: rsaKey, hash: crypto.SHA384},
+	"RS512": {kind: rsaKey, hash: crypto.SHA512},
+	"PS256": {kind: rsaKey, hash: crypto.SHA256, pss: true},
+	"PS384": {kind: rsaKey, hash: crypto.SHA384, pss: true},
+	"PS512": {kind: rsaKey, hash: crypto.SHA512, pss: true},
+	"ES256": {kind: ecdsaKey, hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {kind: ecdsaKey, hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {kind: ecdsaKey, hash: crypto.SHA512, curve: elliptic.P521()},
+	"EdDSA": {kind: ed25519Key},
+}
+
+// jwsHeader is the protected header of a JWS
+type jwsHeader struct {
+	Alg  string   `json:"alg"`
+	B64  *bool    `json:"b64"`  // False if the payload is not base64url encoded (RFC 7797)
+	Crit []string `json:"crit"` // Extensions that must be understood
+}
+
+// loadSigningKey reads the public key used by the manager to sign its
+// responses, given as a PEM public key or certificate
+func loadSigningKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found on " + path)
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, errors.New("Unsupported PEM block: " + block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+
+	return nil, errors.New("Unsupported signing key type")
+}
+
+// verifyDetachedJWS checks a JWS compact serialization with detached payload
+// (RFC 7515 appendix F) is a valid signature of payload made with key
+func verifyDetachedJWS(jws string, payload []byte, key crypto.PublicKey) error {
+	if len(jws) == 0 {
+		return &SignatureError{Reason: "response not signed"}
+	}
+
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 || len(parts[1]) > 0 {
+		return &SignatureError{Reason: "not a detached JWS"}
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return &SignatureError{Reason: "invalid header encoding"}
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return &SignatureError{Reason: "invalid header"}
+	}
+	for _, crit := range header.Crit {
+		if crit != "b64" {
+			return &SignatureError{Reason: "unsupported critical header " + crit}
+		}
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return &SignatureError{Reason: "invalid signature encoding"}
+	}
+
+	input := parts[0] + "."
+	if header.B64 != nil && !*header.B64 {
+		input += string(payload)
+	} else {
+		input += base64.RawURLEncoding.EncodeToString(payload)
+	}
+
+	if err := verifySignature(header.Alg, key, []byte(input), signature); err != nil {
+		return &SignatureError{Reason: err.Error()}
+	}
+
+	return nil
+}
+
+// verifySignature checks a JWS signature of input made with the algorithm alg.
+// The algorithm must match the type of the key, so a key can't be used with an
+// algorithm it was not meant for.
+func verifySignature(alg string, key crypto.PublicKey, input, signature []byte) error {
+	algorithm, ok := jwsAlgorithms[alg]
+	if !ok {
+		return errors.New("unsupported algorithm " + alg)
+	}
+
+	var digest []byte
+	if algorithm.hash != 0 {
+		h := algorithm.hash.New()
+		h.Write(input)
+		digest = h.Sum(nil)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm.kind != rsaKey {
+			break
+		}
+		if algorithm.pss {
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+			return checkSignature(rsa.VerifyPSS(k, algorithm.hash, digest, signature, opts) == nil)
+		}
+		return checkSignature(rsa.VerifyPKCS1v15(k, algorithm.hash, digest, signature) == nil)
+
+	case *ecdsa.PublicKey:
+		// The curve is fixed by the algorithm, e.g. ES256 is only valid on P-256
+		if algorithm.kind != ecdsaKey || k.Curve != algorithm.curve {
+			break
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return checkSignature(false)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return checkSignature(ecdsa.Verify(k, digest, r, s))
+
+	case ed25519.PublicKey:
+		if algorithm.kind != ed25519Key {
+			break
+		}
+		return checkSignature(ed25519.Verify(k, input, signature))
+	}
+
+	return errors.New("algorithm " + alg + " doesn't match the key")
+}
+
+// checkSignature returns an error if the signature is not valid
+func checkSignature(valid bool) error {
+	if !valid {
+		return errors.New("bad signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to create a detached JWS of payload
+func testSign(t *testing.T, key crypto.Signer, header string, payload []byte) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(header))
+	input := []byte(encoded + "." + base64.RawURLEncoding.EncodeToString(payload))
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, input)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(input)
+		r, s, e := ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		err = e
+	default:
+		digest := sha256.Sum256(input)
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	assert.NoError(t, err, "Unexpected error")
+
+	return encoded + ".." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Helper function to save the public key of a signer on a PEM file
+func testSigningKeyFile(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	assert.NoError(t, err, "Unexpected error")
+	path := filepath.Join(t.TempDir(), "manager.pub")
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+	return path
+}
+
+// Test valid signatures made with every type of key
+func Test_VerifyDetachedJWS(t *testing.T) {
+	rsaSigner, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecSigner, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edSigner, _ := ed25519.GenerateKey(rand.Reader)
+	payload := []byte(`{"status": "registered"}`)
+
+	for alg, key := range map[string]crypto.Signer{"RS256": rsaSigner, "ES256": ecSigner, "EdDSA": edSigner} {
+		jws := testSign(t, key, `{"alg":"`+alg+`"}`, payload)
+		err := verifyDetachedJWS(jws, payload, key.Public())
+		assert.NoError(t, err, "Unexpected error on "+alg)
+	}
+}
+
+// Test tampered, unsigned and forged responses are rejected
+func Test_VerifyDetachedJWS_Invalid(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	payload := []byte(`{"status": "registered"}`)
+	jws := testSign(t, key, `{"alg":"ES256"}`, payload)
+
+	var signatureErr *SignatureError
+	err := verifyDetachedJWS(jws, []byte(`{"status": "claimed"}`), key.Public())
+	assert.ErrorAs(t, err, &signatureErr, "Tampered payload accepted")
+	err = verifyDetachedJWS(jws, payload, other.Public())
+	assert.ErrorAs(t, err, &signatureErr, "Wrong key accepted")
+	err = verifyDetachedJWS("", payload, key.Public())
+	assert.ErrorAs(t, err, &signatureErr, "Unsigned payload accepted")
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + ".."
+	err = verifyDetachedJWS(none, payload, key.Public())
+	assert.ErrorAs(t, err, &signatureErr, "Algorithm none accepted")
+
+	rsaJWS := testSign(t, key, `{"alg":"RS256"}`, payload)
+	err = verifyDetachedJWS(rsaJWS, payload, key.Public())
+	assert.ErrorAs(t, err, &signatureErr, "Algorithm not matching the key accepted")
+
+	crit := testSign(t, key, `{"alg":"ES256","crit":["exp"],"exp":1}`, payload)
+	err = verifyDetachedJWS(crit, payload, key.Public())
+	assert.ErrorAs(t, err, &signatureErr, "Unknown critical header accepted")
+}
+
+// Test the signing key can be given as a public key or a certificate
+func Test_LoadSigningKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	loaded, err := loadSigningKey(testSigningKeyFile(t, key))
+	assert.NoError(t, err, "Unexpected error")
+	assert.True(t, key.PublicKey.Equal(loaded), "Wrong key")
+
+	cert := testCert(t, key, "manager", false, nil, nil)
+	path := filepath.Join(t.TempDir(), "manager.crt")
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+	loaded, err = loadSigningKey(path)
+	assert.NoError(t, err, "Unexpected error")
+	assert.True(t, key.PublicKey.Equal(loaded), "Wrong key")
+
+	_, err = loadSigningKey(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err, "Expected error")
+}
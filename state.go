@@ -0,0 +1,80 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+)
+
+// Statuses of the registration persisted on the database, in the order they
+// are reached
+const (
+	stateRegistering = "registering"      // Waiting for an UUID
+	stateRegistered  = registeredResponse // Waiting to be claimed
+	stateClaimed     = claimedResponse    // Credentials received, not installed yet
+	stateProvisioned = "provisioned"      // Credentials installed and finish script run
+)
+
+// State is the progress of the registration of a device, so it can be resumed
+// from the same point after a restart
+type State struct {
+	Hash          string    `json:"hash"`           // Hash of the device
+	UUID          string    `json:"uuid"`           // UUID issued by the manager
+	Status        string    `json:"status"`         // Current status of the registration
+	Nodename      string    `json:"nodename"`       // Name of the node received on the claim
+	Manager       string    `json:"manager"`        // URL of the manager that issued the UUID
+	Fingerprint   string    `json:"fingerprint"`    // SHA-256 of the installed certificate
+	RegisteredAt  time.Time `json:"registered_at"`  // Time the UUID was received
+	ClaimedAt     time.Time `json:"claimed_at"`     // Time the credentials were received
+	ProvisionedAt time.Time `json:"provisioned_at"` // Time the credentials were installed
+	UpdatedAt     time.Time `json:"updated_at"`     // Time of the last change
+	Attempts      int       `json:"attempts"`       // Failed or pending requests on the current status
+	LastError     string    `json:"last_error"`     // Last failure on the current status
+}
+
+// newState creates the state of a device that hasn't been registered yet
+func newState(hash string) *State {
+	return &State{Hash: hash, Status: stateRegistering}
+}
+
+// Transition moves the state to a new status at the given time, clearing the
+// attempts made on the previous one
+func (s *State) Transition(status string, now time.Time) {
+	s.Status = status
+	s.Attempts = 0
+	s.LastError = ""
+	s.UpdatedAt = now
+
+	switch status {
+	case stateRegistered:
+		s.RegisteredAt = now
+	case stateClaimed:
+		s.ClaimedAt = now
+	case stateProvisioned:
+		s.ProvisionedAt = now
+	}
+}
+
+// Attempt records a request that didn't move the state forward, along with its
+// error if it failed
+func (s *State) Attempt(err error, now time.Time) {
+	s.Attempts++
+	s.UpdatedAt = now
+	if err != nil {
+		s.LastError = err.Error()
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Database drivers, sqlite3 is only available on cgo builds
+const (
+	sqliteDriver = "sqlite3"
+	jsonDriver   = "json"
+	boltDriver   = "bolt"
+)
+
+// sqliteHeader starts every SQLite database file
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// Identity is the UUID issued by a manager to a device. A device may hold an
+// UUID from each manager it registered with.
+type Identity struct {
+	Manager string `json:"manager"` // URL of the manager, empty if unknown
+	Hash    string `json:"hash"`    // Hash of the device
+	UUID    string `json:"uuid"`    // UUID issued by the manager
+}
+
+// StateStore persists the registration of the devices, identified by their
+// hash
+type StateStore interface {
+	// LoadUUID returns the UUID issued by a manager for a hash, or an empty
+	// string
+	LoadUUID(manager, hash string) (string, error)
+	// StoreUUID saves the UUID issued by a manager for a hash, replacing the
+	// previous one
+	StoreUUID(manager, hash, uuid string) error
+	// DeleteUUID removes the UUID issued by a manager for a hash
+	DeleteUUID(manager, hash string) error
+	// ListIdentities returns every UUID, sorted by hash and manager
+	ListIdentities() ([]Identity, error)
+	// LoadState returns the registration state of a hash, or nil
+	LoadState(hash string) (*State, error)
+	// ListStates returns the registration state of every hash, sorted by hash
+	ListStates() ([]*State, error)
+	// StoreState saves the registration state, replacing the previous one
+	StoreState(state *State) error
+	// DeleteState removes the registration state of a hash
+	DeleteState(hash string) error
+	// ReplaceRegistrations replaces every UUID and state at once, keeping the
+	// previous ones on error
+	ReplaceRegistrations(identities []Identity, states []*State) error
+	// AddEvent appends an event, removing the ones beyond the retention
+	AddEvent(event Event) error
+	// LoadEvents returns the newest events oldest first, all if limit is 0
+	LoadEvents(limit int) ([]Event, error)
+	// Close releases the store
+	Close()
+}
+
+// sortIdentities sorts identities by hash and manager
+func sortIdentities(identities []Identity) {
+	sort.Slice(identities, func(i, j int) bool {
+		if identities[i].Hash != identities[j].Hash {
+			return identities[i].Hash < identities[j].Hash
+		}
+		return identities[i].Manager < identities[j].Manager
+	})
+}
+
+// storeDrivers creates the stores by driver name. It returns nil if the store
+// can't be opened.
+var storeDrivers = map[string]func(StoreConfig) StateStore{
+	jsonDriver: func(config StoreConfig) StateStore {
+		if store := NewJSONStore(config); store != nil {
+			return store
+		}
+		return nil
+	},
+	boltDriver: func(config StoreConfig) StateStore {
+		if store := NewBoltStore(config); store != nil {
+			return store
+		}
+		return nil
+	},
+}
+
+// storeDriverNames returns the names of the available drivers, sorted
+func storeDriverNames() []string {
+	var names []string
+	for name := range storeDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// newStateStore opens the store of a driver. If no driver is given sqlite3 is
+// used when available and json otherwise.
+func newStateStore(driver string, config StoreConfig) (StateStore, error) {
+	if len(driver) == 0 {
+		driver = jsonDriver
+		if _, ok := storeDrivers[sqliteDriver]; ok {
+			driver = sqliteDriver
+		}
+	}
+
+	open, ok := storeDrivers[driver]
+	if !ok {
+		return nil, errors.New("Unknown database driver " + driver +
+			" (available: " + strings.Join(storeDriverNames(), ", ") + ")")
+	}
+
+	// A build without cgo falls back to json on the same path, which may
+	// already hold the database of a build with sqlite3
+	if driver != sqliteDriver && isSQLiteFile(config.Path) {
+		return nil, errors.New(config.Path + " is a sqlite3 database, use a build with cgo or " +
+			"-db-driver " + driver + " with another -db")
+	}
+
+	if config.Logger == nil {
+		config.Logger = logrus.New()
+	}
+	store := open(config)
+	if store == nil {
+		return nil, errors.New("Error opening " + driver + " database " + config.Path)
+	}
+
+	return store, nil
+}
+
+// isSQLiteFile checks if a file is a SQLite database
+func isSQLiteFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+
+	return bytes.Equal(header, sqliteHeader)
+}
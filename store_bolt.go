@@ -0,0 +1,396 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Version of the layout of the bolt state file. Version 1 kept the UUID only
+// on the states.
+const boltStoreVersion = 2
+
+// Maximum time waiting for another process to release the bolt file
+const boltOpenTimeout = 5 * time.Second
+
+var (
+	boltMetaBucket       = []byte("meta")       // Layout version
+	boltIdentitiesBucket = []byte("identities") // UUIDs by hash and manager
+	boltStatesBucket     = []byte("states")     // States by hash, as JSON
+	boltEventsBucket     = []byte("events")     // Events by sequence, as JSON
+	boltVersionKey       = []byte("version")
+)
+
+// BoltStore keeps the state on an embedded bolt key/value file. It doesn't
+// need cgo. The file is only opened during each transaction, locked for the
+// other processes while it is changed and shared while it is read, so the
+// commands can be run while the service is running.
+type BoltStore struct {
+	config StoreConfig
+}
+
+// NewBoltStore opens a bolt state file, creating it if it doesn't exist. A
+// read only store only opens existing files of the current layout. It returns
+// nil if the file can't be opened.
+func NewBoltStore(config StoreConfig) *BoltStore {
+	s := &BoltStore{config: config}
+
+	if s.config.Logger == nil {
+		s.config.Logger = logrus.New()
+	}
+	logger := s.config.Logger
+
+	if len(s.config.Path) == 0 {
+		return nil
+	}
+
+	prepare := initBoltStore
+	if s.config.ReadOnly {
+		prepare = checkBoltStore
+	}
+	if err := s.update(prepare); err != nil {
+		logger.Errorf("Error opening %s: %v", s.config.Path, err)
+		return nil
+	}
+
+	return s
+}
+
+// open opens the file, waiting for the other processes to release it
+func (s *BoltStore) open() (*bolt.DB, error) {
+	return bolt.Open(s.config.Path, 0600, &bolt.Options{
+		Timeout:  boltOpenTimeout,
+		ReadOnly: s.config.ReadOnly,
+	})
+}
+
+// view runs a read only transaction
+func (s *BoltStore) view(fn func(*bolt.Tx) error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+// update runs a read-write transaction, or a read only one if the store is
+// read only
+func (s *BoltStore) update(fn func(*bolt.Tx) error) error {
+	if s.config.ReadOnly {
+		return s.view(fn)
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// initBoltStore creates the buckets and checks the layout version
+func initBoltStore(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+	if err != nil {
+		return err
+	}
+	for _, name := range [][]byte{boltIdentitiesBucket, boltStatesBucket, boltEventsBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	if value := meta.Get(boltVersionKey); value != nil {
+		version, err := strconv.Atoi(string(value))
+		if err != nil {
+			return errors.New("Invalid state file version: " + string(value))
+		}
+		if version > boltStoreVersion {
+			return errors.New("State file version " + string(value) + " is newer than the supported " +
+				strconv.Itoa(boltStoreVersion))
+		}
+		if version < 2 {
+			if err := upgradeBoltIdentities(tx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return meta.Put(boltVersionKey, []byte(strconv.Itoa(boltStoreVersion)))
+}
+
+// checkBoltStore checks the file can be read without changing it
+func checkBoltStore(tx *bolt.Tx) error {
+	meta := tx.Bucket(boltMetaBucket)
+	if meta == nil {
+		return errors.New("Not a state file")
+	}
+	if value := string(meta.Get(boltVersionKey)); value != strconv.Itoa(boltStoreVersion) {
+		return errors.New("State file version " + value + " is not the supported " +
+			strconv.Itoa(boltStoreVersion) + ", it is upgraded when opened for writing")
+	}
+
+	return nil
+}
+
+// upgradeBoltIdentities copies the UUIDs kept on the states of version 1
+func upgradeBoltIdentities(tx *bolt.Tx) error {
+	bucket := tx.Bucket(boltIdentitiesBucket)
+
+	return tx.Bucket(boltStatesBucket).ForEach(func(k, v []byte) error {
+		state, err := getBoltState(tx, string(k))
+		if err != nil || len(state.UUID) == 0 {
+			return err
+		}
+
+		return bucket.Put(boltIdentityKey(state.Manager, state.Hash), []byte(state.UUID))
+	})
+}
+
+// boltIdentityKey returns the key of the UUID issued by a manager for a hash.
+// The hash goes first so the identities are sorted like sortIdentities does.
+func boltIdentityKey(manager, hash string) []byte {
+	return []byte(hash + "\x00" + manager)
+}
+
+// LoadUUID returns the UUID issued by a manager for a hash
+func (s *BoltStore) LoadUUID(manager, hash string) (uuid string, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		uuid = string(tx.Bucket(boltIdentitiesBucket).Get(boltIdentityKey(manager, hash)))
+		return nil
+	})
+
+	return
+}
+
+// StoreUUID saves the UUID issued by a manager for a hash
+func (s *BoltStore) StoreUUID(manager, hash, uuid string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIdentitiesBucket).Put(boltIdentityKey(manager, hash), []byte(uuid))
+	})
+}
+
+// DeleteUUID removes the UUID issued by a manager for a hash
+func (s *BoltStore) DeleteUUID(manager, hash string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIdentitiesBucket).Delete(boltIdentityKey(manager, hash))
+	})
+}
+
+// ListIdentities returns every UUID, sorted by hash and manager
+func (s *BoltStore) ListIdentities() (identities []Identity, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIdentitiesBucket).ForEach(func(k, v []byte) error {
+			parts := bytes.SplitN(k, []byte{0}, 2)
+			if len(parts) != 2 {
+				return errors.New("Invalid identity key: " + string(k))
+			}
+			identities = append(identities, Identity{
+				Manager: string(parts[1]),
+				Hash:    string(parts[0]),
+				UUID:    string(v),
+			})
+			return nil
+		})
+	})
+
+	return
+}
+
+// LoadState returns the registration state of a hash, or nil
+func (s *BoltStore) LoadState(hash string) (state *State, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		state, err = getBoltState(tx, hash)
+		return err
+	})
+
+	return
+}
+
+// ListStates returns the registration state of every hash, sorted by hash
+func (s *BoltStore) ListStates() (states []*State, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStatesBucket).ForEach(func(k, v []byte) error {
+			state, err := getBoltState(tx, string(k))
+			if err != nil {
+				return err
+			}
+			states = append(states, state)
+			return nil
+		})
+	})
+
+	return
+}
+
+// StoreState saves the registration state, replacing the previous one
+func (s *BoltStore) StoreState(state *State) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return putBoltState(tx, state)
+	})
+}
+
+// DeleteState removes the registration state of a hash
+func (s *BoltStore) DeleteState(hash string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStatesBucket).Delete([]byte(hash))
+	})
+}
+
+// ReplaceRegistrations replaces every UUID and state on a single transaction
+func (s *BoltStore) ReplaceRegistrations(identities []Identity, states []*State) error {
+	return s.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltIdentitiesBucket, boltStatesBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		bucket := tx.Bucket(boltIdentitiesBucket)
+		for _, identity := range identities {
+			if err := bucket.Put(boltIdentityKey(identity.Manager, identity.Hash), []byte(identity.UUID)); err != nil {
+				return err
+			}
+		}
+		for _, state := range states {
+			if err := putBoltState(tx, state); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// AddEvent appends an event, removing the ones beyond the retention
+func (s *BoltStore) AddEvent(event Event) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltEventsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := bucket.Put(key, value); err != nil {
+			return err
+		}
+
+		return pruneBoltEvents(bucket, s.config.History, event.Time)
+	})
+}
+
+// pruneBoltEvents removes the events beyond the retention. Keys are sorted by
+// sequence, so the oldest events come first.
+func pruneBoltEvents(bucket *bolt.Bucket, retention HistoryRetention, now time.Time) error {
+	total := 0
+	bucket.ForEach(func(k, v []byte) error {
+		total++
+		return nil
+	})
+
+	var expired [][]byte
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		var event Event
+		if err := json.Unmarshal(v, &event); err != nil {
+			return errors.New("Invalid event: " + err.Error())
+		}
+		if !retention.expired(len(expired), total, event.Time, now) {
+			break
+		}
+		expired = append(expired, k)
+	}
+
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadEvents returns the newest events oldest first, all if limit is 0
+func (s *BoltStore) LoadEvents(limit int) (events []Event, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltEventsBucket).Cursor()
+		for k, v := cursor.Last(); k != nil && (limit <= 0 || len(events) < limit); k, v = cursor.Prev() {
+			var event Event
+			if err := json.Unmarshal(v, &event); err != nil {
+				return errors.New("Invalid event: " + err.Error())
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+
+	// Read newest first
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return
+}
+
+// Close does nothing, the file is released after every transaction
+func (s *BoltStore) Close() {}
+
+// getBoltState decodes the state of a hash, nil if there is none
+func getBoltState(tx *bolt.Tx, hash string) (*State, error) {
+	value := tx.Bucket(boltStatesBucket).Get([]byte(hash))
+	if value == nil {
+		return nil, nil
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(value, state); err != nil {
+		return nil, errors.New("Invalid state of " + hash + ": " + err.Error())
+	}
+	state.Hash = hash
+
+	return state, nil
+}
+
+// putBoltState encodes and saves a state
+func putBoltState(tx *bolt.Tx, state *State) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltStatesBucket).Put([]byte(state.Hash), value)
+}
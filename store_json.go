@@ -0,0 +1,391 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Version of the format of the JSON state file. Version 1 kept the UUID only
+// on the states.
+const jsonStoreVersion = 2
+
+// Lock file taken while the state file is changed
+const (
+	jsonLockSuffix  = ".lock"
+	jsonLockTimeout = 5 * time.Second
+	jsonLockRetry   = 50 * time.Millisecond
+)
+
+// jsonStoreFile is the content of the JSON state file
+type jsonStoreFile struct {
+	Version    int               `json:"version"`
+	Identities []Identity        `json:"identities"`       // UUIDs sorted by hash and manager
+	States     map[string]*State `json:"states"`           // States by hash
+	Events     []Event           `json:"events,omitempty"` // Events oldest first
+}
+
+// JSONStore keeps the state on a JSON file, replaced atomically on every
+// change. It doesn't need cgo. The file is read again before every change,
+// made while holding a lock file, so the changes of other processes are kept.
+type JSONStore struct {
+	config StoreConfig
+	out    Output
+
+	mutex      sync.Mutex
+	identities []Identity
+	states     map[string]*State
+	events     []Event
+}
+
+// NewJSONStore opens a JSON state file, which is created on the first change
+// if it doesn't exist. It returns nil if the file can't be read.
+func NewJSONStore(config StoreConfig) *JSONStore {
+	s := &JSONStore{
+		config: config,
+		out:    Output{Path: config.Path, Mode: 0600, UID: -1, GID: -1},
+		states: make(map[string]*State),
+	}
+
+	if s.config.Logger == nil {
+		s.config.Logger = logrus.New()
+	}
+	logger := s.config.Logger
+
+	if len(s.config.Path) == 0 {
+		return nil
+	}
+
+	if err := s.load(); err != nil {
+		logger.Error(err)
+		return nil
+	}
+
+	return s
+}
+
+// load reads the file again, an empty state if it doesn't exist
+func (s *JSONStore) load() error {
+	data, err := ioutil.ReadFile(s.config.Path)
+	if os.IsNotExist(err) {
+		s.identities, s.states, s.events = nil, make(map[string]*State), nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file jsonStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("Invalid state file %s: %v", s.config.Path, err)
+	}
+	if file.Version > jsonStoreVersion {
+		return fmt.Errorf("State file version %d is newer than the supported %d", file.Version, jsonStoreVersion)
+	}
+	s.states = make(map[string]*State, len(file.States))
+	for hash, state := range file.States {
+		state.Hash = hash
+		s.states[hash] = state
+		if file.Version < 2 && len(state.UUID) > 0 {
+			file.Identities = append(file.Identities, Identity{Manager: state.Manager, Hash: hash, UUID: state.UUID})
+		}
+	}
+	s.identities = file.Identities
+	sortIdentities(s.identities)
+	s.events = file.Events
+
+	return nil
+}
+
+// lock takes the lock file, waiting up to jsonLockTimeout for other processes
+// to release it, and reads the file again. It returns the function releasing
+// the lock.
+func (s *JSONStore) lock() (unlock func(), err error) {
+	if s.config.ReadOnly {
+		return nil, errors.New("The state file is open read only")
+	}
+
+	s.mutex.Lock()
+	defer func() {
+		if err != nil {
+			s.mutex.Unlock()
+		}
+	}()
+
+	path := s.config.Path + jsonLockSuffix
+	if err = os.MkdirAll(filepath.Dir(path), outputDirMode); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(jsonLockTimeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("Error locking %s: %v", path, err)
+		}
+		time.Sleep(jsonLockRetry)
+	}
+
+	if err = s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		f.Close()
+		s.mutex.Unlock()
+	}, nil
+}
+
+// read reads the file again, keeping the last state read if it fails
+func (s *JSONStore) read() error {
+	identities, states, events := s.identities, s.states, s.events
+	if err := s.load(); err != nil {
+		s.identities, s.states, s.events = identities, states, events
+		return err
+	}
+
+	return nil
+}
+
+// LoadUUID returns the UUID issued by a manager for a hash
+func (s *JSONStore) LoadUUID(manager, hash string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.read(); err != nil {
+		return "", err
+	}
+
+	if i, ok := s.findIdentity(manager, hash); ok {
+		return s.identities[i].UUID, nil
+	}
+
+	return "", nil
+}
+
+// StoreUUID saves the UUID issued by a manager for a hash
+func (s *JSONStore) StoreUUID(manager, hash, uuid string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if i, ok := s.findIdentity(manager, hash); ok {
+		s.identities[i].UUID = uuid
+	} else {
+		s.identities = append(s.identities, Identity{Manager: manager, Hash: hash, UUID: uuid})
+		sortIdentities(s.identities)
+	}
+
+	return s.save()
+}
+
+// DeleteUUID removes the UUID issued by a manager for a hash
+func (s *JSONStore) DeleteUUID(manager, hash string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	i, ok := s.findIdentity(manager, hash)
+	if !ok {
+		return nil
+	}
+	s.identities = append(s.identities[:i], s.identities[i+1:]...)
+
+	return s.save()
+}
+
+// ListIdentities returns every UUID, sorted by hash and manager
+func (s *JSONStore) ListIdentities() ([]Identity, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.read(); err != nil {
+		return nil, err
+	}
+
+	return append([]Identity(nil), s.identities...), nil
+}
+
+// findIdentity returns the position of the UUID issued by a manager for a hash
+func (s *JSONStore) findIdentity(manager, hash string) (int, bool) {
+	for i, identity := range s.identities {
+		if identity.Manager == manager && identity.Hash == hash {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// LoadState returns a copy of the registration state of a hash, or nil
+func (s *JSONStore) LoadState(hash string) (*State, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.read(); err != nil {
+		return nil, err
+	}
+
+	state, ok := s.states[hash]
+	if !ok {
+		return nil, nil
+	}
+	loaded := *state
+
+	return &loaded, nil
+}
+
+// ListStates returns a copy of the registration state of every hash, sorted
+// by hash
+func (s *JSONStore) ListStates() ([]*State, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.read(); err != nil {
+		return nil, err
+	}
+
+	states := make([]*State, 0, len(s.states))
+	for _, state := range s.states {
+		loaded := *state
+		states = append(states, &loaded)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Hash < states[j].Hash })
+
+	return states, nil
+}
+
+// StoreState saves a copy of the registration state
+func (s *JSONStore) StoreState(state *State) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	stored := *state
+	s.states[state.Hash] = &stored
+
+	return s.save()
+}
+
+// DeleteState removes the registration state of a hash
+func (s *JSONStore) DeleteState(hash string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	delete(s.states, hash)
+
+	return s.save()
+}
+
+// ReplaceRegistrations replaces every UUID and state on a single save
+func (s *JSONStore) ReplaceRegistrations(identities []Identity, states []*State) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s.identities = append([]Identity(nil), identities...)
+	sortIdentities(s.identities)
+	s.states = make(map[string]*State, len(states))
+	for _, state := range states {
+		stored := *state
+		s.states[state.Hash] = &stored
+	}
+
+	return s.save()
+}
+
+// AddEvent appends an event, removing the ones beyond the retention
+func (s *JSONStore) AddEvent(event Event) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s.events = s.config.History.prune(append(s.events, event), event.Time)
+
+	return s.save()
+}
+
+// LoadEvents returns the newest events oldest first, all if limit is 0
+func (s *JSONStore) LoadEvents(limit int) ([]Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.read(); err != nil {
+		return nil, err
+	}
+
+	events := s.events
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+
+	return append([]Event(nil), events...), nil
+}
+
+// Close does nothing, every change is already saved
+func (s *JSONStore) Close() {}
+
+// save replaces the file with the current states
+func (s *JSONStore) save() error {
+	data, err := json.MarshalIndent(jsonStoreFile{
+		Version:    jsonStoreVersion,
+		Identities: s.identities,
+		States:     s.states,
+		Events:     s.events,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := s.out.Write(data); err != nil {
+		return fmt.Errorf("Error saving state file: %v", err)
+	}
+
+	return nil
+}
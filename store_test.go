@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to open a store of every available driver on a temporary
+// directory, along with the path of its file
+func testStores(t *testing.T, test func(t *testing.T, driver string, path string)) {
+	for _, driver := range storeDriverNames() {
+		t.Run(driver, func(t *testing.T) {
+			test(t, driver, filepath.Join(t.TempDir(), "rb-register.db"))
+		})
+	}
+}
+
+// Test the UUID and the state survive reopening the store
+func Test_StateStore(t *testing.T) {
+	testStores(t, func(t *testing.T, driver, path string) {
+		store, err := newStateStore(driver, StoreConfig{Path: path})
+		if !assert.NoError(t, err, "Unexpected error") {
+			return
+		}
+
+		uuid, err := store.LoadUUID("https://manager", "hash")
+		assert.NoError(t, err, "Unexpected error")
+		assert.Empty(t, uuid, "UUID should not exist")
+
+		state := newState("hash")
+		state.UUID = "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"
+		state.Nodename = "node"
+		state.Transition(stateClaimed, time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC))
+		assert.NoError(t, store.StoreState(state), "Unexpected error")
+		assert.NoError(t, store.StoreUUID("https://manager", "other", "00000000-0000-0000-0000-000000000000"), "Unexpected error")
+		store.Close()
+
+		store, err = newStateStore(driver, StoreConfig{Path: path})
+		if !assert.NoError(t, err, "Unexpected error") {
+			return
+		}
+		defer store.Close()
+
+		loaded, err := store.LoadState("hash")
+		assert.NoError(t, err, "Unexpected error")
+		if assert.NotNil(t, loaded, "State not found") {
+			assert.Equal(t, stateClaimed, loaded.Status, "Wrong status")
+			assert.Equal(t, "node", loaded.Nodename, "Wrong nodename")
+			assert.True(t, state.ClaimedAt.Equal(loaded.ClaimedAt), "Wrong claim time")
+		}
+		uuid, _ = store.LoadUUID("https://manager", "other")
+		assert.Equal(t, "00000000-0000-0000-0000-000000000000", uuid, "Wrong UUID")
+
+		assert.NoError(t, store.DeleteState("hash"), "Unexpected error")
+		loaded, _ = store.LoadState("hash")
+		assert.Nil(t, loaded, "State not removed")
+		uuid, _ = store.LoadUUID("https://manager", "other")
+		assert.NotEmpty(t, uuid, "Wrong UUID removed")
+	})
+}
+
+// Test a hash keeps a UUID for every manager, replaced on every store
+func Test_StateStore_Identities(t *testing.T) {
+	testStores(t, func(t *testing.T, driver, path string) {
+		store, err := newStateStore(driver, StoreConfig{Path: path})
+		if !assert.NoError(t, err, "Unexpected error") {
+			return
+		}
+		defer store.Close()
+
+		assert.NoError(t, store.StoreUUID("https://b", "hash", "00000000-0000-0000-0000-000000000000"), "Unexpected error")
+		assert.NoError(t, store.StoreUUID("https://a", "hash", "00000000-0000-0000-0000-000000000000"), "Unexpected error")
+		assert.NoError(t, store.StoreUUID("https://a", "hash", "11111111-1111-1111-1111-111111111111"), "Unexpected error")
+		assert.NoError(t, store.StoreUUID("https://a", "other", "22222222-2222-2222-2222-222222222222"), "Unexpected error")
+
+		uuid, err := store.LoadUUID("https://a", "hash")
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, "11111111-1111-1111-1111-111111111111", uuid, "UUID not replaced")
+		uuid, _ = store.LoadUUID("https://b", "hash")
+		assert.Equal(t, "00000000-0000-0000-0000-000000000000", uuid, "Wrong UUID")
+
+		identities, err := store.ListIdentities()
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, []Identity{
+			{Manager: "https://a", Hash: "hash", UUID: "11111111-1111-1111-1111-111111111111"},
+			{Manager: "https://b", Hash: "hash", UUID: "00000000-0000-0000-0000-000000000000"},
+			{Manager: "https://a", Hash: "other", UUID: "22222222-2222-2222-2222-222222222222"},
+		}, identities, "Wrong identities")
+
+		assert.NoError(t, store.DeleteUUID("https://a", "hash"), "Unexpected error")
+		uuid, _ = store.LoadUUID("https://a", "hash")
+		assert.Empty(t, uuid, "UUID not removed")
+		uuid, _ = store.LoadUUID("https://b", "hash")
+		assert.NotEmpty(t, uuid, "Wrong UUID removed")
+	})
+}
+
+// Test every UUID and state is replaced at once
+func Test_StateStore_ReplaceRegistrations(t *testing.T) {
+	testStores(t, func(t *testing.T, driver, path string) {
+		store, err := newStateStore(driver, StoreConfig{Path: path})
+		if !assert.NoError(t, err, "Unexpected error") {
+			return
+		}
+		defer store.Close()
+
+		assert.NoError(t, store.StoreUUID("https://a", "old", "00000000-0000-0000-0000-000000000000"), "Unexpected error")
+		assert.NoError(t, store.StoreState(newState("old")), "Unexpected error")
+
+		state := newState("hash")
+		state.Transition(stateClaimed, time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC))
+		identities := []Identity{{Manager: "https://a", Hash: "hash", UUID: "11111111-1111-1111-1111-111111111111"}}
+		assert.NoError(t, store.ReplaceRegistrations(identities, []*State{state}), "Unexpected error")
+
+		loaded, err := store.ListIdentities()
+		assert.NoError(t, err, "Unexpected error")
+		assert.Equal(t, identities, loaded, "Wrong identities")
+		states, err := store.ListStates()
+		assert.NoError(t, err, "Unexpected error")
+		if assert.Len(t, states, 1, "Wrong states") {
+			assert.Equal(t, "hash", states[0].Hash, "Wrong hash")
+			assert.Equal(t, stateClaimed, states[0].Status, "Wrong status")
+		}
+	})
+}
+
+// Test a read only bolt store is shared with a store open for writing
+func Test_BoltStore_ReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rb-register.db")
+	assert.Nil(t, NewBoltStore(StoreConfig{Path: path, ReadOnly: true}), "Missing file opened")
+
+	store := NewBoltStore(StoreConfig{Path: path})
+	if !assert.NotNil(t, store, "Store should not be nil") {
+		return
+	}
+	defer store.Close()
+	assert.NoError(t, store.StoreUUID("https://manager", "hash", "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"), "Unexpected error")
+
+	reader := NewBoltStore(StoreConfig{Path: path, ReadOnly: true})
+	if !assert.NotNil(t, reader, "Store should not be nil") {
+		return
+	}
+	defer reader.Close()
+
+	uuid, err := reader.LoadUUID("https://manager", "hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "Wrong UUID")
+	assert.Error(t, reader.StoreUUID("https://manager", "hash", ""), "Expected error")
+	assert.NoError(t, store.StoreState(newState("hash")), "Unexpected error")
+}
+
+// Test the changes made by another process on the JSON file are kept
+func Test_JSONStore_Shared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rb-register.json")
+	service := NewJSONStore(StoreConfig{Path: path})
+	command := NewJSONStore(StoreConfig{Path: path})
+	if !assert.NotNil(t, service, "Store should not be nil") || !assert.NotNil(t, command, "Store should not be nil") {
+		return
+	}
+
+	assert.NoError(t, command.StoreUUID("https://manager", "hash", "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b"), "Unexpected error")
+	assert.NoError(t, service.AddEvent(Event{Time: time.Now(), Hash: "hash", Order: "verify"}), "Unexpected error")
+
+	uuid, err := NewJSONStore(StoreConfig{Path: path}).LoadUUID("https://manager", "hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "Change of the other process lost")
+	uuid, _ = service.LoadUUID("https://manager", "hash")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "Change of the other process not read")
+
+	reader := NewJSONStore(StoreConfig{Path: path, ReadOnly: true})
+	assert.Error(t, reader.DeleteUUID("https://manager", "hash"), "Expected error")
+}
+
+// Test the UUIDs kept on the states of version 1 JSON files are loaded
+func Test_JSONStore_Upgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rb-register.json")
+	ioutil.WriteFile(path, []byte(`{"version": 1, "states": {"hash": {
+		"uuid": "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", "status": "registered", "manager": "https://manager"}}}`), 0600)
+
+	store := NewJSONStore(StoreConfig{Path: path})
+	if !assert.NotNil(t, store, "Store should not be nil") {
+		return
+	}
+
+	uuid, err := store.LoadUUID("https://manager", "hash")
+	assert.NoError(t, err, "Unexpected error")
+	assert.Equal(t, "7a3ddcd8-b1b1-4b47-9a06-29a6e5e4bc7b", uuid, "UUID lost")
+}
+
+// Test unknown drivers and unreadable files are rejected
+func Test_NewStateStore_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rb-register.json")
+	ioutil.WriteFile(path, []byte(`{"version": 99, "states": {}}`), 0600)
+
+	_, err := newStateStore("mysql", StoreConfig{Path: path})
+	assert.Error(t, err, "Expected error")
+	_, err = newStateStore(jsonDriver, StoreConfig{Path: path})
+	assert.Error(t, err, "Expected error")
+}
+
+// Test a sqlite3 database is not opened by the other drivers
+func Test_NewStateStore_SQLite_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rb-register.db")
+	ioutil.WriteFile(path, append([]byte("SQLite format 3\x00"), make([]byte, 84)...), 0600)
+
+	for _, driver := range []string{jsonDriver, boltDriver} {
+		_, err := newStateStore(driver, StoreConfig{Path: path})
+		if assert.Error(t, err, "Expected error") {
+			assert.Contains(t, err.Error(), "is a sqlite3 database", "Wrong error")
+		}
+	}
+}
+
+// Test the events beyond the retention are removed
+func Test_StateStore_Events(t *testing.T) {
+	testStores(t, func(t *testing.T, driver, path string) {
+		retention := HistoryRetention{Keep: 3, Age: time.Hour}
+		store, err := newStateStore(driver, StoreConfig{Path: path, History: retention})
+		if !assert.NoError(t, err, "Unexpected error") {
+			return
+		}
+		defer store.Close()
+
+		now := time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC)
+		orders := []string{"register", "register", "verify", "verify", "verify"}
+		for i, order := range orders {
+			event := Event{Time: now.Add(time.Duration(i) * time.Minute), Order: order, HTTPStatus: 200}
+			assert.NoError(t, store.AddEvent(event), "Unexpected error")
+		}
+
+		events, err := store.LoadEvents(0)
+		assert.NoError(t, err, "Unexpected error")
+		if assert.Len(t, events, 3, "Wrong number of events") {
+			assert.True(t, now.Add(2*time.Minute).Equal(events[0].Time), "Wrong oldest event")
+		}
+		events, _ = store.LoadEvents(1)
+		if assert.Len(t, events, 1, "Wrong number of events") {
+			assert.True(t, now.Add(4*time.Minute).Equal(events[0].Time), "Wrong newest event")
+		}
+
+		assert.NoError(t, store.AddEvent(Event{Time: now.Add(2 * time.Hour), Order: "renew"}), "Unexpected error")
+		events, _ = store.LoadEvents(0)
+		if assert.Len(t, events, 1, "Old events not removed") {
+			assert.Equal(t, "renew", events[0].Order, "Wrong event")
+		}
+	})
+}
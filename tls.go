@@ -0,0 +1,138 @@
+// Copyright (C) 2016 Eneo Tecnologia S.L.
+// Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// newTLSConfig builds the TLS configuration used to connect to the API from
+// the client configuration
+func newTLSConfig(config APIClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+	}
+
+	// Identity presented to the API, usually a certificate installed on the
+	// device at manufacturing time
+	if len(config.ClientCertFile) > 0 || len(config.ClientKeyFile) > 0 {
+		if len(config.ClientCertFile) == 0 || len(config.ClientKeyFile) == 0 {
+			return nil, errors.New("Client certificate and key must be provided together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Private CA used to verify the API instead of the system roots
+	if len(config.CAFile) > 0 {
+		pemCerts, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, errors.New("No certificates found on " + config.CAFile)
+		}
+	}
+
+	if len(config.PinnedKeys) > 0 {
+		pins, err := decodePins(config.PinnedKeys)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// decodePins decodes a list of base64 encoded SHA-256 hashes
+func decodePins(pins []string) ([][]byte, error) {
+	var decoded [][]byte
+
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, errors.New("Invalid SHA-256 pin: " + pin)
+		}
+		decoded = append(decoded, hash)
+	}
+
+	return decoded, nil
+}
+
+// verifyPins checks that the public key of a certificate presented by the
+// API matches one of the pins. If the chain has been verified any certificate
+// on it can be pinned (e.g. the CA), otherwise only the leaf is trusted.
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("API didn't present any certificate")
+	}
+
+	candidates := []*x509.Certificate{cs.PeerCertificates[0]}
+	for _, chain := range cs.VerifiedChains {
+		candidates = append(candidates, chain...)
+	}
+
+	for _, cert := range candidates {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("Certificate of the API doesn't match any pinned key")
+}
+
+// newTransport creates the HTTP transport used to connect to the API. It
+// keeps the defaults of the standard library, like using the proxy from the
+// environment when no other proxy is configured.
+func newTransport(config APIClientConfig) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	// An explicit proxy replaces the one from the environment
+	if len(config.Proxy) > 0 {
+		transport.Proxy, err = newProxyFunc(config.Proxy, config.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return transport, nil
+}
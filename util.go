@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/syslog"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
@@ -76,6 +79,8 @@ func daemonize() {
 	defer cntxt.Release()
 }
 
+// endScript runs script saving its output on logFileName and waits for it to
+// finish. It returns an error if the script exits with non zero status.
 func endScript(script, logFileName string) error {
 	cmd := exec.Command(script)
 
@@ -87,15 +92,41 @@ func endScript(script, logFileName string) error {
 	defer logfile.Close()
 
 	cmd.Stdout = logfile
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
+	cmd.Stderr = logfile
 
-	return nil
+	return cmd.Run()
+}
+
+// sleepContext pauses the current goroutine for the given duration measured
+// by clock. It returns early with the context error if ctx is done before the
+// time elapses.
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) error {
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func displayVersion() {
 	fmt.Println("RB_REGISTER VERSION:\t", version)
 	fmt.Println("GO VERSION:\t\t", goVersion)
 }
+
+// stringList is a flag that can be repeated or given as a comma separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*l = append(*l, v)
+		}
+	}
+
+	return nil
+}